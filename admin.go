@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// methods of metrics which remove state rather than record a value, they
+// apply to metrics of any type
+const (
+	// remove the series with the label values of the metric
+	methodDelete = "delete"
+	// remove all series of the metric, or zero it if it has no labels
+	methodReset = "reset"
+)
+
+func isAdminMethod(method string) bool {
+	return method == methodDelete || method == methodReset
+}
+
+// AdminResult is the response of the admin endpoints
+type AdminResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Delete removes the series given by the label values or labels of m from
+// its metric, and sets the label values of m to those of the series
+func (r *ireg) Delete(m *Metric) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.delete(m)
+}
+
+func (r *ireg) delete(m *Metric) error {
+	handler, ok := r.Handlers[m.Name]
+	if !ok {
+		return fmt.Errorf("Delete: metric %s does not exist", m.Name)
+	}
+
+	// peer labels are given along with the others, as there is no peer to
+	// take them from
+	spec := handler.Spec()
+	if m.Labels != nil {
+		labelValues, err := resolveLabels(spec, spec.labelNames(), m)
+		if err != nil {
+			return err
+		}
+		m.LabelValues, m.Labels = labelValues, nil
+	} else if len(m.LabelValues) < len(spec.Labels) {
+		labelValues, err := padLabelValues(spec, m)
+		if err != nil {
+			return err
+		}
+		m.LabelValues = labelValues
+	}
+
+	var deleted bool
+	switch h := handler.(type) {
+	default:
+		return fmt.Errorf("Delete: metric %s has no labels", m.Name)
+	case VecHandler:
+		deleted = deleteSeries(h, m.LabelValues)
+	case *MultiprocGaugeHandler:
+		deleted = h.delete(m.LabelValues)
+	}
+
+	if !deleted {
+		return fmt.Errorf("Delete: metric %s has no series %v", m.Name, m.LabelValues)
+	}
+
+	return nil
+}
+
+// Reset removes all series of the named metric, metrics without labels
+// are rebuilt to start from scratch
+func (r *ireg) Reset(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reset(name)
+}
+
+func (r *ireg) reset(name string) error {
+	handler, ok := r.Handlers[name]
+	if !ok {
+		return fmt.Errorf("Reset: metric %s does not exist", name)
+	}
+
+	switch h := handler.(type) {
+	case VecHandler:
+		resetSeries(h)
+	case *MultiprocGaugeHandler:
+		h.reset()
+	default:
+		if _, err := r.replace(h.Spec(), false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleAdmin deletes a series or resets a metric as requested by m, and
+// writes an audit log line if it did
+func (r *ireg) handleAdmin(m *Metric) error {
+	var err error
+	switch m.Method {
+	case methodDelete:
+		err = r.delete(m)
+	case methodReset:
+		err = r.reset(m.Name)
+	}
+
+	if err == nil {
+		auditAdmin(m, senderStr(m))
+	}
+	return err
+}
+
+func auditAdmin(m *Metric, by string) {
+	if m.Method == methodDelete {
+		logger.Printf("AUDIT: deleted series %s{%s} requested by %s", m.Name, strings.Join(m.LabelValues, ","), by)
+	} else {
+		logger.Printf("AUDIT: reset %s requested by %s", m.Name, by)
+	}
+}
+
+// senderStr describes the sender of m as far as it is known
+func senderStr(m *Metric) string {
+	if m.peer != nil {
+		return fmt.Sprintf("pid %d uid %d", m.peer.Pid, m.peer.Uid)
+	}
+	if m.Pid != 0 {
+		return fmt.Sprintf("pid %d", m.Pid)
+	}
+	return "unknown sender"
+}
+
+func (h *MultiprocGaugeHandler) delete(labelValues []string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	if _, ok := h.series[key]; !ok {
+		return false
+	}
+	delete(h.series, key)
+
+	return true
+}
+
+func (h *MultiprocGaugeHandler) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.series = make(map[string]*gaugeSeries)
+}
+
+// AdminHandler deletes a series or resets a metric on POST requests, with
+// a json body of the name and, for method delete, label values or labels
+// of the series. Which is done is determined by method.
+func AdminHandler(registry Registry, method string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, &AdminResult{Error: "method not allowed"})
+			return
+		}
+
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFrameSize))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, &AdminResult{Error: err.Error()})
+			return
+		}
+
+		m := &Metric{}
+		if err := json.Unmarshal(data, m); err != nil {
+			writeJSON(w, http.StatusBadRequest, &AdminResult{Error: err.Error()})
+			return
+		}
+		m.Method = method
+
+		if method == methodDelete {
+			err = registry.Delete(m)
+		} else {
+			err = registry.Reset(m.Name)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, &AdminResult{Error: err.Error()})
+			return
+		}
+
+		auditAdmin(m, "http "+r.RemoteAddr)
+		writeJSON(w, http.StatusOK, &AdminResult{OK: true})
+	})
+}
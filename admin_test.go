@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleAdmin(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	for _, spec := range []*MetricSpec{
+		{Type: "counter", Name: "test_24_counter", Help: "Counter"},
+		{Type: "counter", Name: "test_24_vec", Help: "Vec", Labels: []string{"one"}},
+		{Type: "gauge", Name: "test_24_multi", Help: "Multi", Labels: []string{"one"}, MultiprocessMode: "sum"},
+	} {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, m := range []*Metric{
+		{Name: "test_24_counter", Method: "add", Value: 3},
+		{Name: "test_24_vec", Method: "inc", LabelValues: []string{"a"}},
+		{Name: "test_24_vec", Method: "inc", LabelValues: []string{"b"}},
+		{Name: "test_24_multi", Method: "set", Value: 2, LabelValues: []string{"a"}, Pid: 1},
+		{Name: "test_24_multi", Method: "set", Value: 5, LabelValues: []string{"b"}, Pid: 1},
+	} {
+		if err := registry.Handle(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		m  Metric
+		ok bool
+	}{
+		{Metric{Name: "test_24_vec", Method: "delete", admin: true, LabelValues: []string{"a"}}, true},
+		{Metric{Name: "test_24_vec", Method: "delete", admin: true, LabelValues: []string{"a"}}, false},
+		{Metric{Name: "test_24_vec", Method: "delete", admin: true, LabelValues: []string{"a", "b"}}, false},
+		{Metric{Name: "test_24_multi", Method: "delete", admin: true, LabelValues: []string{"b"}}, true},
+		{Metric{Name: "test_24_multi", Method: "delete", admin: true, LabelValues: []string{"c"}}, false},
+		{Metric{Name: "test_24_counter", Method: "delete", admin: true}, false},
+		{Metric{Name: "test_24_counter", Method: "reset", admin: true}, true},
+		{Metric{Name: "test_24_missing", Method: "reset", admin: true}, false},
+	} {
+		if err := registry.Handle(&tt.m); (err == nil) != tt.ok {
+			t.Errorf("Handle(%+v) => %v, want ok %t", tt.m, err, tt.ok)
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		labels []string
+		value  float64
+		found  bool
+	}{
+		{"test_24_counter", nil, 0, true},
+		{"test_24_vec", []string{"a"}, 0, false},
+		{"test_24_vec", []string{"b"}, 1, true},
+		{"test_24_multi", []string{"a"}, 2, true},
+		{"test_24_multi", []string{"b"}, 0, false},
+	} {
+		value, found := gatherValue(t, registry, tt.name, tt.labels...)
+		if value != tt.value || found != tt.found {
+			t.Errorf("%s%v => %g %t, want %g %t", tt.name, tt.labels, value, found, tt.value, tt.found)
+		}
+	}
+
+	if err := registry.Reset("test_24_vec"); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Reset("test_24_multi"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test_24_vec", "test_24_multi"} {
+		if series, _ := registry.Series(name); len(series) != 0 {
+			t.Errorf("%s => %d series after reset, want 0", name, len(series))
+		}
+	}
+}
+
+func TestProcessBatchAdmin(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	spec := &MetricSpec{Type: "counter", Name: "test_24_batch", Help: "Batch", Labels: []string{"one"}}
+	if err := registry.Register(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte(`[
+		{"name":"test_24_batch","method":"inc","label_values":["a"]},
+		{"name":"test_24_batch","method":"delete","label_values":["a"]}
+	]`)
+	for _, tt := range []struct {
+		admin bool
+		found bool
+	}{
+		{false, true},
+		{true, false},
+	} {
+		result := ProcessBatch(registry, Batch{Data: data, Admin: tt.admin})
+		if admin := result.Accepted == 2; admin != tt.admin {
+			t.Errorf("ProcessBatch(admin %t) => %+v", tt.admin, result)
+		}
+		if _, found := gatherValue(t, registry, spec.Name, "a"); found != tt.found {
+			t.Errorf("ProcessBatch(admin %t) => series found %t, want %t", tt.admin, found, tt.found)
+		}
+	}
+}
+
+func TestDatagramAdmin(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	spec := &MetricSpec{Type: "counter", Name: "test_24_datagram", Help: "Datagram", Labels: []string{"one"}}
+	if err := registry.Register(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataCh := make(chan Batch, 1)
+	metricCh := make(chan Metric)
+	doneCh := make(chan bool)
+	defer startReader(conn, func() { DatagramReader(conn, dataCh) })()
+	go DataParser(dataCh, metricCh)
+	processed := make(chan struct{})
+	go func() {
+		DataProcessor(registry, metricCh, doneCh)
+		close(processed)
+	}()
+	defer func() {
+		doneCh <- true
+		<-processed
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// metrics are processed in order, so once b is found the delete of a
+	// has been handled
+	for _, batch := range []string{
+		`[{"name":"test_24_datagram","method":"inc","label_values":["a"]}]`,
+		`[{"name":"test_24_datagram","method":"delete","label_values":["a"]},{"name":"test_24_datagram","method":"reset"}]`,
+		`[{"name":"test_24_datagram","method":"inc","label_values":["b"]}]`,
+	} {
+		if _, err := client.Write([]byte(batch)); err != nil {
+			t.Fatal(err)
+		}
+		// datagrams which find the parser busy are dropped
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, found := gatherValue(t, registry, spec.Name, "b"); found {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, value := range []string{"a", "b"} {
+		if _, found := gatherValue(t, registry, spec.Name, value); !found {
+			t.Errorf("%s[%s] not found, want delete and reset rejected over udp", spec.Name, value)
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	spec := &MetricSpec{Type: "counter", Name: "test_25_vec", Help: "Vec", Labels: []string{"one"}}
+	if err := registry.Register(spec); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"a", "b"} {
+		if err := registry.Handle(&Metric{Name: spec.Name, Method: "inc", LabelValues: []string{v}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		method  string
+		action  string
+		body    string
+		status  int
+		remains int
+	}{
+		{"GET", methodDelete, ``, http.StatusMethodNotAllowed, 2},
+		{"POST", methodDelete, `not json`, http.StatusBadRequest, 2},
+		{"POST", methodDelete, `{"name":"test_25_vec","label_values":["c"]}`, http.StatusNotFound, 2},
+		{"POST", methodDelete, `{"name":"test_25_vec","label_values":["a"]}`, http.StatusOK, 1},
+		{"POST", methodDelete, `{"name":"test_25_vec","labels":{"two":"b"}}`, http.StatusNotFound, 1},
+		{"POST", methodDelete, `{"name":"test_25_vec","labels":{"one":"b"}}`, http.StatusOK, 0},
+		{"POST", methodReset, `{"name":"test_25_missing"}`, http.StatusNotFound, 0},
+		{"POST", methodReset, `{"name":"test_25_vec"}`, http.StatusOK, 0},
+	} {
+		req := httptest.NewRequest(tt.method, "/-/"+tt.action, strings.NewReader(tt.body))
+		rec := httptest.NewRecorder()
+		AdminHandler(registry, tt.action).ServeHTTP(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("%s /-/%s %s => status %d, want %d", tt.method, tt.action, tt.body, rec.Code, tt.status)
+		}
+
+		var r AdminResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.OK != (tt.status == http.StatusOK) || r.OK != (r.Error == "") {
+			t.Errorf("%s /-/%s %s => %+v", tt.method, tt.action, tt.body, r)
+		}
+
+		if series, _ := registry.Series(spec.Name); len(series) != tt.remains {
+			t.Errorf("%s /-/%s %s => %d series remain, want %d", tt.method, tt.action, tt.body, len(series), tt.remains)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Series is a series currently exported by a metric, with its value
+type Series struct {
+	Labels map[string]string `json:"labels"`
+
+	// counters and gauges
+	Value *float64 `json:"value,omitempty"`
+
+	// histograms and summaries
+	Count     *uint64            `json:"count,omitempty"`
+	Sum       *float64           `json:"sum,omitempty"`
+	Buckets   map[string]uint64  `json:"buckets,omitempty"`
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+
+	key string
+}
+
+// SeriesResult is the response of the series endpoint
+type SeriesResult struct {
+	Name   string    `json:"name,omitempty"`
+	Type   string    `json:"type,omitempty"`
+	Series []*Series `json:"series"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func newSeries(m *dto.Metric) *Series {
+	s := &Series{Labels: make(map[string]string)}
+
+	var keys []string
+	for _, pair := range m.GetLabel() {
+		s.Labels[pair.GetName()] = pair.GetValue()
+		keys = append(keys, pair.GetName()+"="+pair.GetValue())
+	}
+	s.key = strings.Join(keys, "\xff")
+
+	// json cannot encode NaN or infinite values, so they are left out
+	value := func(f float64) *float64 {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil
+		}
+		return &f
+	}
+
+	switch {
+	case m.Counter != nil:
+		s.Value = value(m.GetCounter().GetValue())
+	case m.Gauge != nil:
+		s.Value = value(m.GetGauge().GetValue())
+	case m.Untyped != nil:
+		s.Value = value(m.GetUntyped().GetValue())
+	case m.Histogram != nil:
+		h := m.GetHistogram()
+		count := h.GetSampleCount()
+		s.Count = &count
+		s.Sum = value(h.GetSampleSum())
+		s.Buckets = make(map[string]uint64)
+		for _, b := range h.GetBucket() {
+			s.Buckets[strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)] = b.GetCumulativeCount()
+		}
+	case m.Summary != nil:
+		sm := m.GetSummary()
+		count := sm.GetSampleCount()
+		s.Count = &count
+		s.Sum = value(sm.GetSampleSum())
+		s.Quantiles = make(map[string]float64)
+		for _, q := range sm.GetQuantile() {
+			if v := value(q.GetValue()); v != nil {
+				s.Quantiles[strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)] = *v
+			}
+		}
+	}
+
+	return s
+}
+
+// Series returns the series currently exported by the named metric,
+// ordered by their labels
+func (r *ireg) Series(name string) ([]*Series, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	handler, ok := r.Handlers[name]
+	if !ok {
+		return nil, fmt.Errorf("Series: metric %s does not exist", name)
+	}
+
+	result := []*Series{}
+	for _, cm := range collectMetrics(handler.Collector(), nil) {
+		result = append(result, newSeries(cm.Metric))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].key < result[j].key
+	})
+
+	return result, nil
+}
+
+// SpecsHandler responds to GET requests with the specs of all registered
+// metrics, ordered by name
+func SpecsHandler(registry Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, &SeriesResult{Error: "method not allowed"})
+			return
+		}
+
+		names := registry.Names()
+		sort.Strings(names)
+
+		specs := []*MetricSpec{}
+		for _, name := range names {
+			// the metric may have been unregistered in the meantime
+			if spec := registry.Spec(name); spec != nil {
+				specs = append(specs, spec)
+			}
+		}
+
+		writeJSON(w, http.StatusOK, specs)
+	})
+}
+
+// SeriesHandler responds to GET requests with the series currently
+// exported by the metric given by the name query parameter
+func SeriesHandler(registry Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, &SeriesResult{Error: "method not allowed"})
+			return
+		}
+
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			writeJSON(w, http.StatusBadRequest, &SeriesResult{Error: "missing name"})
+			return
+		}
+
+		spec := registry.Spec(name)
+		series, err := registry.Series(name)
+		if spec == nil || err != nil {
+			writeJSON(w, http.StatusNotFound, &SeriesResult{Name: name, Error: fmt.Sprintf("metric %s does not exist", name)})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, &SeriesResult{Name: name, Type: spec.Type, Series: series})
+	})
+}
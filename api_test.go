@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSpecsHandler(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	for _, spec := range []*MetricSpec{
+		{Type: "gauge", Name: "test_22_b", Help: "B", Labels: []string{"one"}},
+		{Type: "counter", Name: "test_22_a", Help: "A"},
+	} {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := SpecsHandler(registry)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/specs", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/v1/specs => status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var specs []*MetricSpec
+	if err := json.Unmarshal(rec.Body.Bytes(), &specs); err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 || specs[0].Name != "test_22_a" || specs[1].Name != "test_22_b" {
+		t.Fatalf("GET /api/v1/specs => %s", rec.Body)
+	}
+	if !sliceEqStr(specs[1].Labels, []string{"one"}) || specs[1].Type != "gauge" {
+		t.Errorf("GET /api/v1/specs => %+v, want labels [one] and type gauge", specs[1])
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/specs", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /api/v1/specs => status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSeriesHandler(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	for _, spec := range []*MetricSpec{
+		{Type: "counter", Name: "test_23_counter", Help: "Counter", Labels: []string{"one"}},
+		{Type: "histogram", Name: "test_23_histogram", Help: "Histogram", Buckets: []float64{1, 10}},
+		{Type: "summary", Name: "test_23_summary", Help: "Summary"},
+	} {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, m := range []*Metric{
+		{Name: "test_23_counter", Method: "add", Value: 2, LabelValues: []string{"b"}},
+		{Name: "test_23_counter", Method: "inc", LabelValues: []string{"a"}},
+		{Name: "test_23_histogram", Method: "observe", Value: 5},
+	} {
+		if err := registry.Handle(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := SeriesHandler(registry)
+
+	get := func(query string, status int) *SeriesResult {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/series"+query, nil))
+		if rec.Code != status {
+			t.Errorf("GET /api/v1/series%s => status %d, want %d", query, rec.Code, status)
+		}
+
+		var r SeriesResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+			t.Fatalf("GET /api/v1/series%s => %s: %s", query, rec.Body, err)
+		}
+		return &r
+	}
+
+	r := get("?name=test_23_counter", http.StatusOK)
+	if r.Type != "counter" || len(r.Series) != 2 {
+		t.Fatalf("GET counter series => %+v", r)
+	}
+	for i, want := range []struct {
+		label string
+		value float64
+	}{{"a", 1}, {"b", 2}} {
+		s := r.Series[i]
+		if s.Labels["one"] != want.label || s.Value == nil || *s.Value != want.value {
+			t.Errorf("GET counter series %d => %+v, want %s = %g", i, s, want.label, want.value)
+		}
+	}
+
+	r = get("?name=test_23_histogram", http.StatusOK)
+	if len(r.Series) != 1 {
+		t.Fatalf("GET histogram series => %+v", r)
+	}
+	if s := r.Series[0]; *s.Count != 1 || *s.Sum != 5 || s.Buckets["1"] != 0 || s.Buckets["10"] != 1 {
+		t.Errorf("GET histogram series => %+v", s)
+	}
+
+	// quantiles of a summary without observations are NaN, and left out
+	r = get("?name=test_23_summary", http.StatusOK)
+	if len(r.Series) != 1 || *r.Series[0].Count != 0 || len(r.Series[0].Quantiles) != 0 {
+		t.Errorf("GET summary series => %+v", r)
+	}
+
+	if r = get("?name=test_23_missing", http.StatusNotFound); r.Error == "" {
+		t.Errorf("GET missing series => no error")
+	}
+	if r = get("", http.StatusBadRequest); r.Error == "" {
+		t.Errorf("GET series without name => no error")
+	}
+}
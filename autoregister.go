@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// MetricTemplate describes metrics which are registered automatically the
+// first time a metric whose name matches Match is handled. The name of
+// the embedded spec is replaced by the name of the metric.
+type MetricTemplate struct {
+	Match string `json:"match"`
+	MetricSpec
+
+	re *regexp.Regexp
+}
+
+// Matches reports whether metrics named name are registered from t
+func (t *MetricTemplate) Matches(name string) bool {
+	return t.re != nil && t.re.MatchString(name)
+}
+
+// Spec returns a copy of the spec of t with the given name
+func (t *MetricTemplate) Spec(name string) *MetricSpec {
+	spec := t.MetricSpec
+	spec.Name = name
+	return &spec
+}
+
+func LoadTemplates(file string) ([]*MetricTemplate, error) {
+	var templates []*MetricTemplate
+
+	templatesFile, err := os.OpenFile(file, os.O_RDONLY, 0644)
+	if err != nil {
+		return templates, err
+	}
+	defer templatesFile.Close()
+
+	return ReadTemplates(templatesFile)
+}
+
+func ReadTemplates(r io.Reader) ([]*MetricTemplate, error) {
+	var result []*MetricTemplate
+
+	jsonBlob, err := ioutil.ReadAll(r)
+	if err != nil {
+		return result, err
+	}
+
+	err = json.Unmarshal(jsonBlob, &result)
+	if err != nil {
+		return result, err
+	}
+
+	for _, t := range result {
+		// anchor the expression so it must match the whole name
+		t.re, err = regexp.Compile("^(?:" + t.Match + ")$")
+		if err != nil {
+			return result, fmt.Errorf("Invalid template match %s: %s", t.Match, err)
+		}
+	}
+
+	return result, nil
+}
+
+// SetTemplates replaces the templates from which unknown metrics are
+// registered, creating at most max metrics in total
+func (r *ireg) SetTemplates(templates []*MetricTemplate, max int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.templates = templates
+	r.autoMax = max
+}
+
+// AutoNames returns the names of automatically registered metrics which
+// still match a template
+func (r *ireg) AutoNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var result []string
+
+	for name := range r.auto {
+		if r.template(name) != nil {
+			result = append(result, name)
+		}
+	}
+
+	return result
+}
+
+func (r *ireg) template(name string) *MetricTemplate {
+	for _, t := range r.templates {
+		if t.Matches(name) {
+			return t
+		}
+	}
+	return nil
+}
+
+// autoRegister registers the metric name from the first template it
+// matches, the caller must hold the lock
+func (r *ireg) autoRegister(name string) (MetricHandler, error) {
+	t := r.template(name)
+	if t == nil {
+		return nil, fmt.Errorf("Handle: metric %s does not exist", name)
+	}
+
+	if len(r.auto) >= r.autoMax {
+		return nil, fmt.Errorf("Handle: metric %s does not exist and auto-registration limit of %d is reached", name, r.autoMax)
+	}
+
+	handler, err := r.register(t.Spec(name))
+	if err != nil {
+		return nil, err
+	}
+
+	r.auto[name] = true
+	logger.Printf("Auto-registered %s", name)
+
+	return handler, nil
+}
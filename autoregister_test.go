@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAutoRegister(t *testing.T) {
+	SetTestLogger()
+
+	templates, err := ReadTemplates(strings.NewReader(`[
+	{
+		"match": "test_14_.*_total",
+		"type": "counter",
+		"help": "Automatically registered counter"
+	},
+	{
+		"match": "test_14_.*_seconds",
+		"type": "histogram",
+		"help": "Automatically registered histogram",
+		"labels": ["one"],
+		"buckets": [0.1, 1, 10]
+	}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := NewRegistry()
+	registry.SetTemplates(templates, 3)
+
+	for _, tt := range []struct {
+		m   Metric
+		err bool
+	}{
+		{Metric{Name: "test_14_a_total", Method: "inc"}, false},
+		{Metric{Name: "test_14_a_total", Method: "inc"}, false},
+		{Metric{Name: "test_14_a_seconds", Method: "observe", Value: 1, LabelValues: []string{"a"}}, false},
+		{Metric{Name: "test_14_a_seconds", Method: "observe", Value: 1}, true},
+		{Metric{Name: "test_14_unknown", Method: "inc"}, true},
+		{Metric{Name: "prefix_test_14_a_total", Method: "inc"}, true},
+		{Metric{Name: "test_14_b_total", Method: "inc"}, false},
+		// limit of 3 automatically registered metrics is reached
+		{Metric{Name: "test_14_c_total", Method: "inc"}, true},
+	} {
+		err := registry.Handle(&tt.m)
+		if (err != nil) != tt.err {
+			t.Errorf("Handle(%+v) => %v, want error %t", tt.m, err, tt.err)
+		}
+	}
+
+	spec := registry.Spec("test_14_a_seconds")
+	if spec == nil || spec.Type != "histogram" || !sliceEqStr(spec.Labels, []string{"one"}) {
+		t.Fatalf("Expected histogram spec from template, but got %+v", spec)
+	}
+
+	names := registry.AutoNames()
+	if len(names) != 3 {
+		t.Fatalf("Expected 3 automatically registered metrics, but got %v", names)
+	}
+
+	// metrics which no longer match a template are not reported
+	registry.SetTemplates(templates[:1], 3)
+	names = registry.AutoNames()
+	if len(names) != 2 || sliceContainsStr(names, "test_14_a_seconds") {
+		t.Fatalf("Expected 2 automatically registered counters, but got %v", names)
+	}
+
+	for _, name := range registry.Names() {
+		if err := registry.Unregister(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names := registry.AutoNames(); len(names) != 0 {
+		t.Fatalf("Expected no automatically registered metrics, but got %v", names)
+	}
+}
+
+func TestReadTemplatesInvalid(t *testing.T) {
+	if _, err := ReadTemplates(strings.NewReader(`[{"match": "test_(", "type": "counter"}]`)); err == nil {
+		t.Fatal("Expected invalid match to throw error, but did not")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// what to do with a new series of a metric which already has max_series
+var overflowPolicies = []string{
+	// drop the metric, the default
+	"reject",
+	// record it in a single series whose label values are all overflowValue
+	"fold",
+}
+
+// label value of the series into which the series of a metric over its
+// max_series are folded
+const overflowValue = "__overflow__"
+
+// defaultMaxSeries is the max_series of specs which do not set it, 0
+// for no limit
+var defaultMaxSeries int
+
+var rejectedSeriesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pmp_rejected_series_total",
+		Help: "Total count of metrics whose series was rejected or folded for exceeding the max_series of their metric",
+	},
+	[]string{"name"},
+)
+
+// maxSeries returns the maximum number of series of the spec, or 0 if
+// there is no limit
+func (spec *MetricSpec) maxSeries() int {
+	if spec.MaxSeries > 0 {
+		return spec.MaxSeries
+	}
+	if len(spec.labelNames()) == 0 {
+		return 0
+	}
+	return defaultMaxSeries
+}
+
+func (spec *MetricSpec) overflow() string {
+	if spec.Overflow == "" {
+		return "reject"
+	}
+	return spec.Overflow
+}
+
+func validateMaxSeries(spec *MetricSpec) error {
+	if spec.MaxSeries < 0 {
+		return fmt.Errorf("Metric %s has max_series %d, but it must not be negative", spec.Name, spec.MaxSeries)
+	}
+
+	if spec.MaxSeries > 0 && len(spec.labelNames()) == 0 {
+		return fmt.Errorf("Metric %s has max_series, but only metrics with labels support it", spec.Name)
+	}
+
+	if spec.Overflow != "" && !sliceContainsStr(overflowPolicies, spec.Overflow) {
+		return fmt.Errorf("Metric %s has unknown overflow policy %s", spec.Name, spec.Overflow)
+	}
+
+	return nil
+}
+
+// admit returns the label values under which m is recorded: its own if
+// its series exists or there is room for it, otherwise those of the
+// overflow series if the policy is fold. With policy reject, an error
+// is returned instead.
+func (t *seriesTracker) admit(m *Metric) ([]string, error) {
+	if t == nil || t.max == 0 || len(m.LabelValues) != t.labels {
+		return m.LabelValues, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// the series folded into does not count against the limit
+	n := len(t.series)
+	if _, ok := t.series[overflowKey(t.labels)]; ok {
+		n--
+	}
+
+	if _, ok := t.series[strings.Join(m.LabelValues, "\xff")]; ok || n < t.max {
+		return m.LabelValues, nil
+	}
+
+	return overflowLabelValues(t.name, t.overflow, m.LabelValues)
+}
+
+// overflowLabelValues returns the label values of the overflow series
+// of a metric over its max_series, or an error if policy is reject
+func overflowLabelValues(name, policy string, labelValues []string) ([]string, error) {
+	rejectedSeriesTotal.WithLabelValues(name).Inc()
+
+	if policy != "fold" {
+		return nil, fmt.Errorf("%s: series %v rejected, metric has reached its max_series", name, labelValues)
+	}
+
+	result := make([]string, len(labelValues))
+	for i := range result {
+		result[i] = overflowValue
+	}
+
+	return result, nil
+}
+
+// overflowKey returns the key of the series which series over the limit of
+// a metric with n labels are folded into
+func overflowKey(n int) string {
+	return strings.TrimSuffix(strings.Repeat(overflowValue+"\xff", n), "\xff")
+}
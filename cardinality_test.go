@@ -0,0 +1,176 @@
+package main
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestValidateMaxSeries(t *testing.T) {
+	for _, tt := range []struct {
+		spec MetricSpec
+		ok   bool
+	}{
+		{MetricSpec{Type: "counter", Name: "test_28_a"}, true},
+		{MetricSpec{Type: "counter", Name: "test_28_a", Labels: []string{"one"}, MaxSeries: 10}, true},
+		{MetricSpec{Type: "counter", Name: "test_28_a", Labels: []string{"one"}, MaxSeries: 10, Overflow: "fold"}, true},
+		{MetricSpec{Type: "counter", Name: "test_28_a", Labels: []string{"one"}, Overflow: "reject"}, true},
+		{MetricSpec{Type: "counter", Name: "test_28_a", MaxSeries: 10}, false},
+		{MetricSpec{Type: "counter", Name: "test_28_a", Labels: []string{"one"}, MaxSeries: -1}, false},
+		{MetricSpec{Type: "counter", Name: "test_28_a", Labels: []string{"one"}, MaxSeries: 10, Overflow: "drop"}, false},
+	} {
+		if err := validateMaxSeries(&tt.spec); (err == nil) != tt.ok {
+			t.Errorf("validateMaxSeries(%+v) => %v, want ok %t", tt.spec, err, tt.ok)
+		}
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	for _, spec := range []*MetricSpec{
+		{Type: "counter", Name: "test_29_reject", Help: "Reject", Labels: []string{"one", "two"}, MaxSeries: 2},
+		{Type: "counter", Name: "test_29_fold", Help: "Fold", Labels: []string{"one", "two"}, MaxSeries: 2, Overflow: "fold"},
+		{Type: "histogram", Name: "test_29_histogram", Help: "Histogram", Labels: []string{"one", "two"}, MaxSeries: 2},
+		{Type: "gauge", Name: "test_29_multi", Help: "Multi", Labels: []string{"one", "two"}, MaxSeries: 2, Overflow: "fold", MultiprocessMode: "sum"},
+		{Type: "counter", Name: "test_29_fold_delete", Help: "Fold", Labels: []string{"one"}, MaxSeries: 2, Overflow: "fold"},
+		{Type: "gauge", Name: "test_29_multi_delete", Help: "Multi", Labels: []string{"one"}, MaxSeries: 2, Overflow: "fold", MultiprocessMode: "sum"},
+	} {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		values []string
+		ok     bool
+	}{
+		{"test_29_reject", "inc", []string{"a", "x"}, true},
+		{"test_29_reject", "inc", []string{"b", "x"}, true},
+		{"test_29_reject", "inc", []string{"c", "x"}, false},
+		{"test_29_reject", "inc", []string{"a", "x"}, true},
+		{"test_29_fold", "inc", []string{"a", "x"}, true},
+		{"test_29_fold", "inc", []string{"b", "x"}, true},
+		{"test_29_fold", "inc", []string{"c", "x"}, true},
+		{"test_29_fold", "inc", []string{"d", "x"}, true},
+		{"test_29_histogram", "observe", []string{"a", "x"}, true},
+		{"test_29_histogram", "observe", []string{"b", "x"}, true},
+		{"test_29_histogram", "observe", []string{"c", "x"}, false},
+		{"test_29_multi", "inc", []string{"a", "x"}, true},
+		{"test_29_multi", "inc", []string{"b", "x"}, true},
+		{"test_29_multi", "inc", []string{"c", "x"}, true},
+		{"test_29_multi", "inc", []string{"d", "x"}, true},
+	} {
+		m := &Metric{Name: tt.name, Method: tt.method, LabelValues: tt.values}
+		if err := registry.Handle(m); (err == nil) != tt.ok {
+			t.Errorf("Handle(%s %v) => %v, want ok %t", tt.name, tt.values, err, tt.ok)
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		values []string
+		value  float64
+		found  bool
+	}{
+		{"test_29_reject", []string{"a", "x"}, 2, true},
+		{"test_29_reject", []string{"c", "x"}, 0, false},
+		{"test_29_fold", []string{"c", "x"}, 0, false},
+		{"test_29_fold", []string{overflowValue, overflowValue}, 2, true},
+		{"test_29_multi", []string{overflowValue, overflowValue}, 2, true},
+	} {
+		value, found := gatherValue(t, registry, tt.name, tt.values...)
+		if value != tt.value || found != tt.found {
+			t.Errorf("%s%v => %g %t, want %g %t", tt.name, tt.values, value, found, tt.value, tt.found)
+		}
+	}
+
+	for name, want := range map[string]float64{
+		"test_29_reject":    1,
+		"test_29_fold":      2,
+		"test_29_histogram": 1,
+		"test_29_multi":     2,
+	} {
+		m := &dto.Metric{}
+		if err := rejectedSeriesTotal.WithLabelValues(name).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		if v := m.GetCounter().GetValue(); v != want {
+			t.Errorf("rejected series of %s => %g, want %g", name, v, want)
+		}
+	}
+
+	// deleting a series makes room for another
+	if err := registry.Delete(&Metric{Name: "test_29_reject", LabelValues: []string{"b", "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Handle(&Metric{Name: "test_29_reject", Method: "inc", LabelValues: []string{"c", "x"}}); err != nil {
+		t.Errorf("Handle after delete => %s", err)
+	}
+
+	// also when series have been folded, which does not take up room
+	for _, name := range []string{"test_29_fold_delete", "test_29_multi_delete"} {
+		for _, value := range []string{"a", "b", "c"} {
+			if err := registry.Handle(&Metric{Name: name, Method: "inc", LabelValues: []string{value}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := registry.Delete(&Metric{Name: name, LabelValues: []string{"a"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := registry.Handle(&Metric{Name: name, Method: "inc", LabelValues: []string{"d"}}); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range []struct {
+			value string
+			found bool
+		}{
+			{"a", false},
+			{"b", true},
+			{"c", false},
+			{"d", true},
+			{overflowValue, true},
+		} {
+			if _, found := gatherValue(t, registry, name, tt.value); found != tt.found {
+				t.Errorf("%s[%s] found => %t, want %t", name, tt.value, found, tt.found)
+			}
+		}
+	}
+}
+
+func TestDefaultMaxSeries(t *testing.T) {
+	SetTestLogger()
+
+	defaultMaxSeries = 1
+	defer func() { defaultMaxSeries = 0 }()
+
+	registry := NewRegistry()
+	for _, spec := range []*MetricSpec{
+		{Type: "counter", Name: "test_30_default", Help: "Default", Labels: []string{"one"}},
+		{Type: "counter", Name: "test_30_own", Help: "Own", Labels: []string{"one"}, MaxSeries: 2},
+	} {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"test_30_default", "a", true},
+		{"test_30_default", "b", false},
+		{"test_30_own", "a", true},
+		{"test_30_own", "b", true},
+		{"test_30_own", "c", false},
+	} {
+		m := &Metric{Name: tt.name, Method: "inc", LabelValues: []string{tt.value}}
+		if err := registry.Handle(m); (err == nil) != tt.ok {
+			t.Errorf("Handle(%s %s) => %v, want ok %t", tt.name, tt.value, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// globalLabels are constant labels added to every metric defined by a spec,
+// but not to the go_, process_ and pmp_ metrics of the aggregator itself
+var globalLabels = map[string]string{}
+
+// labelsFlag is a repeatable flag of key=value labels, whose values may
+// refer to environment variables like $HOSTNAME
+type labelsFlag map[string]string
+
+func (f labelsFlag) String() string {
+	var pairs []string
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f labelsFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("label %q is not of the form key=value", s)
+	}
+
+	if err := validateLabel("", parts[0]); err != nil {
+		return err
+	}
+
+	f[parts[0]] = os.ExpandEnv(parts[1])
+	return nil
+}
+
+// constLabels returns the global labels merged with the const labels of
+// the spec, which take precedence. Global labels which clash with a label
+// of the spec, or with one added by prometheus for its type, are left out.
+func (spec *MetricSpec) constLabels() prometheus.Labels {
+	if len(globalLabels) == 0 && len(spec.ConstLabels) == 0 {
+		return nil
+	}
+
+	labels := seriesLabels(spec)
+	result := prometheus.Labels{}
+	for k, v := range globalLabels {
+		if sliceContainsStr(labels, k) || k == reservedLabels[spec.Type] {
+			continue
+		}
+		result[k] = v
+	}
+	for k, v := range spec.ConstLabels {
+		result[k] = v
+	}
+
+	return result
+}
+
+// seriesLabels returns the labels whose values differ between the series
+// of spec, including the pid label of per process gauges
+func seriesLabels(spec *MetricSpec) []string {
+	labels := spec.labelNames()
+	if isPerProcessMode(spec.MultiprocessMode) {
+		labels = append(append([]string{}, labels...), pidLabel)
+	}
+	return labels
+}
+
+func validateConstLabels(spec *MetricSpec) error {
+	var names []string
+	for name := range spec.ConstLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	labels := seriesLabels(spec)
+	for _, name := range names {
+		if err := validateLabel(spec.Type, name); err != nil {
+			return fmt.Errorf("Metric %s has invalid const label: %s", spec.Name, err)
+		}
+		if sliceContainsStr(labels, name) {
+			return fmt.Errorf("Metric %s has const label %s, which is also one of its labels", spec.Name, name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestLabelsFlag(t *testing.T) {
+	os.Setenv("PMP_TEST_ENV", "prod")
+	defer os.Unsetenv("PMP_TEST_ENV")
+
+	f := labelsFlag{}
+	for _, tt := range []struct {
+		s  string
+		ok bool
+	}{
+		{"app=web", true},
+		{"env=$PMP_TEST_ENV", true},
+		{"host=${PMP_TEST_MISSING}", true},
+		{"path=a=b", true},
+		{"app", false},
+		{"=web", false},
+		{"__app=web", false},
+		{"my-app=web", false},
+	} {
+		if err := f.Set(tt.s); (err == nil) != tt.ok {
+			t.Errorf("Set(%q) => %v, want ok %t", tt.s, err, tt.ok)
+		}
+	}
+
+	if s, want := f.String(), "app=web,env=prod,host=,path=a=b"; s != want {
+		t.Errorf("String() => %q, want %q", s, want)
+	}
+}
+
+func TestValidateConstLabels(t *testing.T) {
+	for _, tt := range []struct {
+		spec MetricSpec
+		ok   bool
+	}{
+		{MetricSpec{Type: "counter", Name: "test_35_a", ConstLabels: map[string]string{"app": "web"}}, true},
+		{MetricSpec{Type: "counter", Name: "test_35_a", Labels: []string{"one"}, ConstLabels: map[string]string{"app": "web"}}, true},
+		{MetricSpec{Type: "counter", Name: "test_35_a", Labels: []string{"app"}, ConstLabels: map[string]string{"app": "web"}}, false},
+		{MetricSpec{Type: "counter", Name: "test_35_a", PeerLabels: []string{"pid"}, ConstLabels: map[string]string{"pid": "1"}}, false},
+		{MetricSpec{Type: "gauge", Name: "test_35_a", MultiprocessMode: "all", ConstLabels: map[string]string{"pid": "1"}}, false},
+		{MetricSpec{Type: "counter", Name: "test_35_a", ConstLabels: map[string]string{"a-b": "web"}}, false},
+		{MetricSpec{Type: "histogram", Name: "test_35_a", ConstLabels: map[string]string{"le": "1"}}, false},
+	} {
+		if err := validateConstLabels(&tt.spec); (err == nil) != tt.ok {
+			t.Errorf("validateConstLabels(%+v) => %v, want ok %t", tt.spec, err, tt.ok)
+		}
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	SetTestLogger()
+
+	globalLabels["env"] = "prod"
+	globalLabels["app"] = "global"
+	defer func() {
+		delete(globalLabels, "env")
+		delete(globalLabels, "app")
+	}()
+
+	registry := NewRegistry()
+	for _, spec := range []*MetricSpec{
+		{Type: "counter", Name: "test_36_counter", Help: "Counter"},
+		{Type: "counter", Name: "test_36_vec", Help: "Vec", Labels: []string{"one"}, ConstLabels: map[string]string{"app": "web"}},
+		{Type: "gauge", Name: "test_36_multi", Help: "Multi", MultiprocessMode: "all", ConstLabels: map[string]string{"app": "web"}},
+		// global labels which clash with those of the spec are left out
+		{Type: "counter", Name: "test_36_clash", Help: "Clash", Labels: []string{"env"}},
+	} {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, m := range []*Metric{
+		{Name: "test_36_counter", Method: "inc"},
+		{Name: "test_36_vec", Method: "inc", LabelValues: []string{"a"}},
+		{Name: "test_36_multi", Method: "set", Value: 3, Pid: 1},
+		{Name: "test_36_clash", Method: "inc", LabelValues: []string{"dev"}},
+	} {
+		if err := registry.Handle(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// gathered label values are ordered by label name
+	for _, tt := range []struct {
+		name   string
+		values []string
+		value  float64
+	}{
+		{"test_36_counter", []string{"global", "prod"}, 1},
+		{"test_36_vec", []string{"web", "prod", "a"}, 1},
+		{"test_36_multi", []string{"web", "prod", "1"}, 3},
+		{"test_36_clash", []string{"global", "dev"}, 1},
+	} {
+		if value, found := gatherValue(t, registry, tt.name, tt.values...); !found || value != tt.value {
+			t.Errorf("%s%v => %g %t, want %g", tt.name, tt.values, value, found, tt.value)
+		}
+	}
+}
+
+func TestConstLabelsClash(t *testing.T) {
+	globalLabels["env"] = "prod"
+	globalLabels["le"] = "global"
+	globalLabels["pid"] = "global"
+	defer func() {
+		delete(globalLabels, "env")
+		delete(globalLabels, "le")
+		delete(globalLabels, "pid")
+	}()
+
+	for _, tt := range []struct {
+		spec   MetricSpec
+		labels []string
+	}{
+		{MetricSpec{Type: "counter"}, []string{"env", "le", "pid"}},
+		{MetricSpec{Type: "counter", Labels: []string{"env"}}, []string{"le", "pid"}},
+		{MetricSpec{Type: "histogram", ConstLabels: map[string]string{"env": "dev"}}, []string{"env", "pid"}},
+		{MetricSpec{Type: "gauge", MultiprocessMode: "all"}, []string{"env", "le"}},
+		{MetricSpec{Type: "gauge", PeerLabels: []string{"pid"}}, []string{"env", "le"}},
+	} {
+		var labels []string
+		for label := range tt.spec.constLabels() {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		if !sliceEqStr(labels, tt.labels) {
+			t.Errorf("constLabels(%+v) => %v, want %v", tt.spec, labels, tt.labels)
+		}
+		if err := validateConstLabels(&tt.spec); err != nil {
+			t.Errorf("validateConstLabels(%+v) => %s", tt.spec, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var expiredTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pmp_expired_series_total",
+		Help: "Total count of series removed for not being updated within the ttl of their metric",
+	},
+	[]string{"name"},
+)
+
+// ttl returns the time after which series of the spec which have not
+// been updated are removed, or 0 if they are kept forever
+func (spec *MetricSpec) ttl() time.Duration {
+	if spec.TTL == "" {
+		return 0
+	}
+	d, _ := time.ParseDuration(spec.TTL)
+	return d
+}
+
+func validateTTL(spec *MetricSpec) error {
+	if spec.TTL == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(spec.TTL)
+	if err != nil {
+		return fmt.Errorf("Metric %s has invalid ttl %s: %s", spec.Name, spec.TTL, err)
+	}
+
+	if d <= 0 {
+		return fmt.Errorf("Metric %s has ttl %s, but it must be positive", spec.Name, spec.TTL)
+	}
+
+	if len(spec.labelNames()) == 0 {
+		return fmt.Errorf("Metric %s has ttl, but only metrics with labels support it", spec.Name)
+	}
+
+	return nil
+}
+
+// Expire removes the series of all metrics which have not been updated
+// within the ttl of their spec before now, and returns how many it removed
+func (r *ireg) Expire(now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int
+	for name, handler := range r.Handlers {
+		var expired int
+		switch h := handler.(type) {
+		case VecHandler:
+			for _, labelValues := range h.tracked().expired(now) {
+				if h.Vec().DeleteLabelValues(labelValues...) {
+					expired++
+				}
+			}
+		case *MultiprocGaugeHandler:
+			expired = h.expire(now)
+		}
+
+		if expired > 0 {
+			expiredTotal.WithLabelValues(name).Add(float64(expired))
+			n += expired
+		}
+	}
+
+	return n
+}
+
+// expire removes the series which have not been updated by any process
+// within the ttl before now
+func (h *MultiprocGaugeHandler) expire(now time.Time) int {
+	ttl := h.spec.ttl()
+	if ttl == 0 {
+		return 0
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var n int
+	for key, series := range h.series {
+		if now.Sub(series.updated) >= ttl {
+			delete(h.series, key)
+			n++
+		}
+	}
+
+	return n
+}
+
+// SeriesExpirer periodically removes series which have not been updated
+// within the ttl of their metric from registry
+func SeriesExpirer(registry Registry, interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if n := registry.Expire(now); n > 0 {
+			logger.Printf("Removed %d expired series", n)
+		}
+	}
+}
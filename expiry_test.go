@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestValidateTTL(t *testing.T) {
+	for _, tt := range []struct {
+		spec MetricSpec
+		ok   bool
+	}{
+		{MetricSpec{Type: "counter", Name: "test_26_a"}, true},
+		{MetricSpec{Type: "counter", Name: "test_26_a", Labels: []string{"one"}, TTL: "10m"}, true},
+		{MetricSpec{Type: "counter", Name: "test_26_a", PeerLabels: []string{"pid"}, TTL: "1h"}, true},
+		{MetricSpec{Type: "counter", Name: "test_26_a", TTL: "10m"}, false},
+		{MetricSpec{Type: "counter", Name: "test_26_a", Labels: []string{"one"}, TTL: "10"}, false},
+		{MetricSpec{Type: "counter", Name: "test_26_a", Labels: []string{"one"}, TTL: "-1m"}, false},
+		{MetricSpec{Type: "counter", Name: "test_26_a", Labels: []string{"one"}, TTL: "0s"}, false},
+	} {
+		if err := validateTTL(&tt.spec); (err == nil) != tt.ok {
+			t.Errorf("validateTTL(%+v) => %v, want ok %t", tt.spec, err, tt.ok)
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	for _, spec := range []*MetricSpec{
+		{Type: "counter", Name: "test_27_counter", Help: "Counter", Labels: []string{"one"}, TTL: "1m"},
+		{Type: "histogram", Name: "test_27_histogram", Help: "Histogram", Labels: []string{"one"}, TTL: "1m"},
+		{Type: "gauge", Name: "test_27_multi", Help: "Multi", Labels: []string{"one"}, MultiprocessMode: "sum", TTL: "1m"},
+		{Type: "gauge", Name: "test_27_forever", Help: "Forever", Labels: []string{"one"}},
+	} {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handle := func(labelValue string) {
+		for _, m := range []*Metric{
+			{Name: "test_27_counter", Method: "inc", LabelValues: []string{labelValue}},
+			{Name: "test_27_histogram", Method: "observe", Value: 1, LabelValues: []string{labelValue}},
+			{Name: "test_27_multi", Method: "set", Value: 1, LabelValues: []string{labelValue}, Pid: 1},
+			{Name: "test_27_forever", Method: "set", Value: 1, LabelValues: []string{labelValue}},
+		} {
+			if err := registry.Handle(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	start := time.Now()
+	handle("a")
+	handle("b")
+
+	if n := registry.Expire(start.Add(30 * time.Second)); n != 0 {
+		t.Errorf("Expire after 30s => %d, want 0", n)
+	}
+
+	// updating a keeps it from expiring
+	time.Sleep(10 * time.Millisecond)
+	handle("a")
+
+	if n := registry.Expire(start.Add(time.Minute + 5*time.Millisecond)); n != 3 {
+		t.Errorf("Expire after 1m => %d, want 3", n)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		count int
+	}{
+		{"test_27_counter", 1},
+		{"test_27_histogram", 1},
+		{"test_27_multi", 1},
+		{"test_27_forever", 2},
+	} {
+		series, err := registry.Series(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(series) != tt.count {
+			t.Errorf("%s => %d series, want %d", tt.name, len(series), tt.count)
+		} else if series[0].Labels["one"] != "a" {
+			t.Errorf("%s => series %v remains, want a", tt.name, series[0].Labels)
+		}
+	}
+
+	m := &dto.Metric{}
+	if err := expiredTotal.WithLabelValues("test_27_counter").Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if v := m.GetCounter().GetValue(); v != 1 {
+		t.Errorf("expired series of test_27_counter => %g, want 1", v)
+	}
+
+	if n := registry.Expire(time.Now().Add(2 * time.Minute)); n != 3 {
+		t.Errorf("Expire after 2m => %d, want 3", n)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// formats of metric definition files by extension, files with other
+// extensions are read as json
+var specFormats = map[string]string{
+	".json": "json",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".toml": "toml",
+}
+
+var (
+	// header of each metric definition in a toml file
+	tomlMetricRe = regexp.MustCompile(`(?m)^[ \t]*\[\[[ \t]*metric[ \t]*\]\]`)
+)
+
+func ValidateFormat(format string) error {
+	switch format {
+	case "", "json", "yaml", "toml":
+		return nil
+	}
+	return fmt.Errorf("Unknown metrics format %s", format)
+}
+
+// specFormat returns format if it is set, otherwise the format of file
+// according to its extension
+func specFormat(file, format string) string {
+	if format != "" {
+		return format
+	}
+	if f, ok := specFormats[filepath.Ext(file)]; ok {
+		return f
+	}
+	return "json"
+}
+
+// ReadSpecsFormat reads metric definitions in the given format from r
+func ReadSpecsFormat(r io.Reader, format string) ([]*MetricSpec, error) {
+	switch format {
+	default:
+		return nil, fmt.Errorf("Unknown metrics format %s", format)
+	case "json":
+		return ReadSpecs(r)
+	case "yaml":
+		return readYAMLSpecs(r)
+	case "toml":
+		return readTOMLSpecs(r)
+	}
+}
+
+// readYAMLSpecs reads a yaml sequence of metric definitions from r
+func readYAMLSpecs(r io.Reader) ([]*MetricSpec, error) {
+	var result []*MetricSpec
+
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		return result, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(blob, &doc); err != nil {
+		return result, err
+	}
+	if len(doc.Content) == 0 {
+		return result, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.SequenceNode {
+		return result, errors.New("metric definitions must be a yaml sequence")
+	}
+
+	for _, item := range root.Content {
+		var v interface{}
+		if err := item.Decode(&v); err != nil {
+			return result, fmt.Errorf("line %d: %s", item.Line, err)
+		}
+		spec, err := specFromValue(v, item.Line)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, spec)
+	}
+
+	return result, nil
+}
+
+// readTOMLSpecs reads metric definitions from r, as a toml array of
+// tables named metric
+func readTOMLSpecs(r io.Reader) ([]*MetricSpec, error) {
+	var result []*MetricSpec
+
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		return result, err
+	}
+
+	var doc struct {
+		Metric []map[string]interface{} `toml:"metric"`
+	}
+	md, err := toml.Decode(string(blob), &doc)
+	if err != nil {
+		return result, err
+	}
+	// keys within metric tables are all decoded into their maps, even if
+	// the toml package does not count nested tables as such
+	var unknown []string
+	for _, key := range md.Undecoded() {
+		if len(key) > 0 && key[0] != "metric" {
+			unknown = append(unknown, key.String())
+		}
+	}
+	if len(unknown) > 0 {
+		return result, fmt.Errorf("unknown keys %s, metric definitions must be tables named metric", strings.Join(unknown, ", "))
+	}
+
+	// the line of each definition is the line of its header
+	headers := tomlMetricRe.FindAllIndex(blob, -1)
+
+	for i, v := range doc.Metric {
+		var line int
+		if i < len(headers) {
+			line = lineAt(blob, int64(headers[i][0]))
+		}
+		spec, err := specFromValue(v, line)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, spec)
+	}
+
+	return result, nil
+}
+
+// specFromValue builds a spec from a generic value by way of json, so
+// that definitions in every format are read the same way
+func specFromValue(v interface{}, line int) (*MetricSpec, error) {
+	blob, err := json.Marshal(jsonValue(v))
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %s", line, err)
+	}
+
+	spec := &MetricSpec{line: line}
+	if err := json.Unmarshal(blob, spec); err != nil {
+		return nil, fmt.Errorf("line %d: %s", line, err)
+	}
+
+	return spec, nil
+}
+
+// jsonValue converts maps with non-string keys, as decoded from yaml, to
+// maps with string keys which can be encoded as json
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			result[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			result[key] = jsonValue(value)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, value := range v {
+			result[i] = jsonValue(value)
+		}
+		return result
+	}
+	return v
+}
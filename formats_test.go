@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadSpecsFormat(t *testing.T) {
+	expected, err := ReadSpecs(strings.NewReader(`[
+	{
+		"type": "counter",
+		"name": "test_17_counter_vec",
+		"help": "Test 17 counter vector",
+		"labels": ["one", "two"]
+	},
+	{
+		"type": "histogram",
+		"name": "test_17_histogram",
+		"help": "Test 17 histogram",
+		"buckets": [0.1, 1, 10]
+	},
+	{
+		"type": "summary",
+		"name": "test_17_summary",
+		"help": "Test 17 summary",
+		"objectives": {"0.5": 0.05, "0.9": 0.01}
+	},
+	{
+		"type": "gauge",
+		"name": "test_17_gauge",
+		"help": "Test 17 gauge",
+		"multiprocess_mode": "livesum"
+	}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		format string
+		input  string
+		lines  []int
+	}{
+		{"yaml", `
+# counters
+- type: counter
+  name: test_17_counter_vec
+  help: Test 17 counter vector
+  labels: [one, two]
+- type: histogram
+  name: test_17_histogram
+  help: Test 17 histogram
+  buckets:
+    - 0.1
+    - 1
+    - 10
+- type: summary
+  name: test_17_summary
+  help: Test 17 summary
+  objectives:
+    0.5: 0.05
+    0.9: 0.01
+- {type: gauge, name: test_17_gauge, help: Test 17 gauge, multiprocess_mode: livesum}
+`, []int{3, 7, 14, 20}},
+		{"toml", `
+# counters
+[[metric]]
+type = "counter"
+name = "test_17_counter_vec"
+help = "Test 17 counter vector"
+labels = ["one", "two"]
+
+[[metric]]
+type = "histogram"
+name = "test_17_histogram"
+help = "Test 17 histogram"
+buckets = [0.1, 1, 10]
+
+[[metric]]
+type = "summary"
+name = "test_17_summary"
+help = "Test 17 summary"
+  [metric.objectives]
+  "0.5" = 0.05
+  "0.9" = 0.01
+
+[[metric]]
+type = "gauge"
+name = "test_17_gauge"
+help = "Test 17 gauge"
+multiprocess_mode = "livesum"
+`, []int{3, 9, 15, 23}},
+	} {
+		specs, err := ReadSpecsFormat(strings.NewReader(tt.input), tt.format)
+		if err != nil {
+			t.Fatalf("ReadSpecsFormat(%s) => unexpected error %s", tt.format, err)
+		}
+		if len(specs) != len(expected) {
+			t.Fatalf("ReadSpecsFormat(%s) => %d specs, want %d", tt.format, len(specs), len(expected))
+		}
+		for i, spec := range specs {
+			if !specEqual(spec, expected[i]) {
+				t.Errorf("ReadSpecsFormat(%s) spec %d => %+v, want %+v", tt.format, i, spec, expected[i])
+			}
+			if spec.line != tt.lines[i] {
+				t.Errorf("ReadSpecsFormat(%s) spec %d line => %d, want %d", tt.format, i, spec.line, tt.lines[i])
+			}
+			if _, err := buildHandler(spec); err != nil {
+				t.Errorf("ReadSpecsFormat(%s) spec %d => invalid %s", tt.format, i, err)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		format string
+		input  string
+	}{
+		{"yaml", `type: counter`},
+		{"yaml", `- [counter]`},
+		{"toml", `type = "counter"
+type = "gauge"`},
+		{"toml", `[[metrics]]
+type = "counter"`},
+		{"toml", `type = "counter"`},
+		{"xml", `<metrics/>`},
+	} {
+		if _, err := ReadSpecsFormat(strings.NewReader(tt.input), tt.format); err == nil {
+			t.Errorf("ReadSpecsFormat(%s, %q) => expected error, but got none", tt.format, tt.input)
+		}
+	}
+}
+
+func TestSpecFormat(t *testing.T) {
+	for _, tt := range []struct {
+		file   string
+		format string
+		r      string
+	}{
+		{"metrics.json", "", "json"},
+		{"metrics.yaml", "", "yaml"},
+		{"metrics.yml", "", "yaml"},
+		{"metrics.toml", "", "toml"},
+		{"metrics", "", "json"},
+		{"metrics.conf", "yaml", "yaml"},
+		{"metrics.json", "toml", "toml"},
+	} {
+		if r := specFormat(tt.file, tt.format); r != tt.r {
+			t.Errorf("specFormat(%s, %s) => %s, want %s", tt.file, tt.format, r, tt.r)
+		}
+	}
+}
@@ -2,16 +2,90 @@ package main
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
+// methods supported by each type of metric
+var metricMethods = map[string][]string{
+	"counter":   {"inc", "add"},
+	"gauge":     {"set", "inc", "dec", "add", "sub", "set_to_current_time"},
+	"histogram": {"observe"},
+	"summary":   {"observe"},
+}
+
+// checkMethod returns an error if the method of m is not supported by
+// metrics of type typ
+func checkMethod(typ string, m *Metric) error {
+	if !sliceContainsStr(metricMethods[typ], m.Method) {
+		return fmt.Errorf("%s: invalid %s method %s", m.Name, typ, m.Method)
+	}
+	return nil
+}
+
 type MetricHandler interface {
 	Spec() *MetricSpec
 	Handle(*Metric) error
 	Collector() prometheus.Collector
 }
 
+// VecHandler is implemented by handlers of metrics with labels
+type VecHandler interface {
+	MetricHandler
+	Vec() *prometheus.MetricVec
+	tracked() *seriesTracker
+}
+
+// collectedMetric is a series of a collector with its label values in
+// the order of the labels of its spec
+type collectedMetric struct {
+	LabelValues []string
+	Metric      *dto.Metric
+}
+
+// collectMetrics collects c and returns each of its series, with the
+// values of the given labels
+func collectMetrics(c prometheus.Collector, labels []string) []*collectedMetric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var result []*collectedMetric
+	for metric := range ch {
+		m := &dto.Metric{}
+		if err := metric.Write(m); err != nil {
+			continue
+		}
+		pairs := make(map[string]string)
+		for _, pair := range m.GetLabel() {
+			pairs[pair.GetName()] = pair.GetValue()
+		}
+		labelValues := make([]string, len(labels))
+		for i, label := range labels {
+			labelValues[i] = pairs[label]
+		}
+		result = append(result, &collectedMetric{labelValues, m})
+	}
+
+	return result
+}
+
+// collectSeries returns the label values of each series currently
+// exported by h, in the order of the labels of its spec
+func collectSeries(h VecHandler) [][]string {
+	var result [][]string
+
+	for _, cm := range collectMetrics(h.Collector(), h.Spec().labelNames()) {
+		result = append(result, cm.LabelValues)
+	}
+
+	return result
+}
+
 type CounterHandler struct {
 	spec    *MetricSpec
 	Counter prometheus.Counter
@@ -24,7 +98,7 @@ func (h *CounterHandler) Spec() *MetricSpec {
 func (h *CounterHandler) Handle(m *Metric) error {
 	switch m.Method {
 	default:
-		logger.Printf("Invalid counter method %s for metric %s\n", m.Method, m.Name)
+		return checkMethod("counter", m)
 	case "inc":
 		h.Counter.Inc()
 	case "add":
@@ -44,6 +118,7 @@ func (h *CounterHandler) Collector() prometheus.Collector {
 type CounterVecHandler struct {
 	spec       *MetricSpec
 	CounterVec *prometheus.CounterVec
+	tracker    *seriesTracker
 }
 
 func (h *CounterVecHandler) Spec() *MetricSpec {
@@ -51,14 +126,25 @@ func (h *CounterVecHandler) Spec() *MetricSpec {
 }
 
 func (h *CounterVecHandler) Handle(m *Metric) error {
-	metric, err := h.CounterVec.GetMetricWithLabelValues(m.LabelValues...)
+	// check before the series is created
+	if err := checkMethod("counter", m); err != nil {
+		return err
+	}
+
+	labelValues, err := h.tracker.admit(m)
+	if err != nil {
+		return err
+	}
+
+	metric, err := h.CounterVec.GetMetricWithLabelValues(labelValues...)
 	if err != nil {
 		return err
 	}
+	h.tracker.touch(labelValues)
 
 	switch m.Method {
 	default:
-		logger.Printf("Invalid counter method %s for metric %s\n", m.Method, m.Name)
+		return checkMethod("counter", m)
 	case "inc":
 		metric.Inc()
 	case "add":
@@ -75,6 +161,14 @@ func (h *CounterVecHandler) Collector() prometheus.Collector {
 	return h.CounterVec
 }
 
+func (h *CounterVecHandler) Vec() *prometheus.MetricVec {
+	return h.CounterVec.MetricVec
+}
+
+func (h *CounterVecHandler) tracked() *seriesTracker {
+	return h.tracker
+}
+
 type GaugeHandler struct {
 	spec  *MetricSpec
 	Gauge prometheus.Gauge
@@ -87,7 +181,7 @@ func (h *GaugeHandler) Spec() *MetricSpec {
 func (h *GaugeHandler) Handle(m *Metric) error {
 	switch m.Method {
 	default:
-		logger.Printf("Invalid gauge method %s for metric %s\n", m.Method, m.Name)
+		return checkMethod("gauge", m)
 	case "set":
 		h.Gauge.Set(m.Value)
 	case "inc":
@@ -112,6 +206,7 @@ func (h *GaugeHandler) Collector() prometheus.Collector {
 type GaugeVecHandler struct {
 	spec     *MetricSpec
 	GaugeVec *prometheus.GaugeVec
+	tracker  *seriesTracker
 }
 
 func (h *GaugeVecHandler) Spec() *MetricSpec {
@@ -119,14 +214,25 @@ func (h *GaugeVecHandler) Spec() *MetricSpec {
 }
 
 func (h *GaugeVecHandler) Handle(m *Metric) error {
-	metric, err := h.GaugeVec.GetMetricWithLabelValues(m.LabelValues...)
+	// check before the series is created
+	if err := checkMethod("gauge", m); err != nil {
+		return err
+	}
+
+	labelValues, err := h.tracker.admit(m)
 	if err != nil {
 		return err
 	}
 
+	metric, err := h.GaugeVec.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		return err
+	}
+	h.tracker.touch(labelValues)
+
 	switch m.Method {
 	default:
-		logger.Printf("Invalid gauge vec method %s for metric %s\n", m.Method, m.Name)
+		return checkMethod("gauge", m)
 	case "set":
 		metric.Set(m.Value)
 	case "inc":
@@ -148,6 +254,14 @@ func (h *GaugeVecHandler) Collector() prometheus.Collector {
 	return h.GaugeVec
 }
 
+func (h *GaugeVecHandler) Vec() *prometheus.MetricVec {
+	return h.GaugeVec.MetricVec
+}
+
+func (h *GaugeVecHandler) tracked() *seriesTracker {
+	return h.tracker
+}
+
 type HistogramHandler struct {
 	spec      *MetricSpec
 	Histogram prometheus.Histogram
@@ -158,6 +272,10 @@ func (h *HistogramHandler) Spec() *MetricSpec {
 }
 
 func (h *HistogramHandler) Handle(m *Metric) error {
+	if err := checkMethod("histogram", m); err != nil {
+		return err
+	}
+
 	h.Histogram.Observe(m.Value)
 	return nil
 }
@@ -169,6 +287,7 @@ func (h *HistogramHandler) Collector() prometheus.Collector {
 type HistogramVecHandler struct {
 	spec         *MetricSpec
 	HistogramVec *prometheus.HistogramVec
+	tracker      *seriesTracker
 }
 
 func (h *HistogramVecHandler) Spec() *MetricSpec {
@@ -176,10 +295,21 @@ func (h *HistogramVecHandler) Spec() *MetricSpec {
 }
 
 func (h *HistogramVecHandler) Handle(m *Metric) error {
-	metric, err := h.HistogramVec.GetMetricWithLabelValues(m.LabelValues...)
+	// check before the series is created
+	if err := checkMethod("histogram", m); err != nil {
+		return err
+	}
+
+	labelValues, err := h.tracker.admit(m)
+	if err != nil {
+		return err
+	}
+
+	metric, err := h.HistogramVec.GetMetricWithLabelValues(labelValues...)
 	if err != nil {
 		return err
 	}
+	h.tracker.touch(labelValues)
 	metric.Observe(m.Value)
 	return nil
 }
@@ -188,6 +318,14 @@ func (h *HistogramVecHandler) Collector() prometheus.Collector {
 	return h.HistogramVec
 }
 
+func (h *HistogramVecHandler) Vec() *prometheus.MetricVec {
+	return h.HistogramVec.MetricVec
+}
+
+func (h *HistogramVecHandler) tracked() *seriesTracker {
+	return h.tracker
+}
+
 type SummaryHandler struct {
 	spec    *MetricSpec
 	Summary prometheus.Summary
@@ -198,6 +336,10 @@ func (h *SummaryHandler) Spec() *MetricSpec {
 }
 
 func (h *SummaryHandler) Handle(m *Metric) error {
+	if err := checkMethod("summary", m); err != nil {
+		return err
+	}
+
 	h.Summary.Observe(m.Value)
 	return nil
 }
@@ -209,6 +351,7 @@ func (h *SummaryHandler) Collector() prometheus.Collector {
 type SummaryVecHandler struct {
 	spec       *MetricSpec
 	SummaryVec *prometheus.SummaryVec
+	tracker    *seriesTracker
 }
 
 func (h *SummaryVecHandler) Spec() *MetricSpec {
@@ -216,10 +359,21 @@ func (h *SummaryVecHandler) Spec() *MetricSpec {
 }
 
 func (h *SummaryVecHandler) Handle(m *Metric) error {
-	metric, err := h.SummaryVec.GetMetricWithLabelValues(m.LabelValues...)
+	// check before the series is created
+	if err := checkMethod("summary", m); err != nil {
+		return err
+	}
+
+	labelValues, err := h.tracker.admit(m)
+	if err != nil {
+		return err
+	}
+
+	metric, err := h.SummaryVec.GetMetricWithLabelValues(labelValues...)
 	if err != nil {
 		return err
 	}
+	h.tracker.touch(labelValues)
 	metric.Observe(m.Value)
 	return nil
 }
@@ -227,3 +381,11 @@ func (h *SummaryVecHandler) Handle(m *Metric) error {
 func (h *SummaryVecHandler) Collector() prometheus.Collector {
 	return h.SummaryVec
 }
+
+func (h *SummaryVecHandler) Vec() *prometheus.MetricVec {
+	return h.SummaryVec.MetricVec
+}
+
+func (h *SummaryVecHandler) tracked() *seriesTracker {
+	return h.tracker
+}
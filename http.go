@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Printf("ERROR (writeJSON): %s", err)
+	}
+}
+
+// IngestHandler accepts a json batch of metrics in the body of a POST
+// request, the same as is accepted on the socket, and responds with
+// the outcome of processing it
+func IngestHandler(registry Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, &BatchResult{Error: "method not allowed"})
+			return
+		}
+
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFrameSize))
+		if err != nil {
+			CountMetric("error")
+			writeJSON(w, http.StatusBadRequest, &BatchResult{Error: err.Error()})
+			return
+		}
+
+		result := ProcessBatch(registry, Batch{Data: data})
+		if result.Error != "" {
+			writeJSON(w, http.StatusBadRequest, result)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+}
+
+// ReloadHandler reloads the metric definitions on POST requests with
+// reload, and responds with the result. With the dry_run query parameter
+// set to true, only reports what a reload would change.
+func ReloadHandler(reload func(dryRun bool) *ReloadResult) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, &ReloadResult{Error: "method not allowed"})
+			return
+		}
+
+		var dryRun bool
+		if v := r.URL.Query().Get("dry_run"); v != "" {
+			var err error
+			dryRun, err = strconv.ParseBool(v)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, &ReloadResult{Error: "invalid dry_run " + v})
+				return
+			}
+		}
+
+		result := reload(dryRun)
+		if !result.OK {
+			writeJSON(w, http.StatusUnprocessableEntity, result)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIngestHandler(t *testing.T) {
+	SetTestLogger()
+	specs := getTestSpecs(t, 9)
+
+	registry := NewRegistry()
+	for _, spec := range specs {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handler := IngestHandler(registry)
+
+	for _, tt := range []struct {
+		method string
+		body   string
+		status int
+		r      BatchResult
+	}{
+		{
+			"POST",
+			`[{"name":"test_9_counter","method":"inc"},{"name":"test_9_gauge","method":"set","value":3}]`,
+			http.StatusOK,
+			BatchResult{Accepted: 2},
+		},
+		{
+			"POST",
+			`[{"name":"test_9_counter","method":"inc"},{"name":"test_9_missing","method":"inc"}]`,
+			http.StatusOK,
+			BatchResult{Accepted: 1, Rejected: 1},
+		},
+		{
+			"POST",
+			`[{"name":"test_9_counter","method":"set","value":1},{"name":"test_9_histogram_vec","method":"inc","label_values":["a","b","c"]}]`,
+			http.StatusOK,
+			BatchResult{Accepted: 0, Rejected: 2},
+		},
+		{
+			"POST",
+			`[{"name":"test_9_counter","method":"reset"},{"name":"test_9_counter_vec","method":"delete","label_values":["a","b","c"]}]`,
+			http.StatusOK,
+			BatchResult{Accepted: 0, Rejected: 2},
+		},
+		{"POST", `[]`, http.StatusOK, BatchResult{}},
+		{"POST", `not json`, http.StatusBadRequest, BatchResult{}},
+		{"GET", ``, http.StatusMethodNotAllowed, BatchResult{}},
+	} {
+		req := httptest.NewRequest(tt.method, "/ingest", strings.NewReader(tt.body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("%s /ingest %s => status %d, want %d", tt.method, tt.body, rec.Code, tt.status)
+		}
+
+		var r BatchResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if tt.status != http.StatusOK {
+			if r.Error == "" {
+				t.Errorf("%s /ingest %s => expected error, but got none", tt.method, tt.body)
+			}
+		} else if r.Accepted != tt.r.Accepted || r.Rejected != tt.r.Rejected || len(r.Errors) != tt.r.Rejected {
+			t.Errorf("%s /ingest %s => %+v, want %+v", tt.method, tt.body, r, tt.r)
+		}
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	specs := []*MetricSpec{
+		{Type: "counter", Name: "test_21_counter", Help: "Counter"},
+	}
+	handler := ReloadHandler(func(dryRun bool) *ReloadResult {
+		return Reload(registry, specs, true, dryRun)
+	})
+
+	for _, tt := range []struct {
+		method string
+		query  string
+		specs  []*MetricSpec
+		status int
+		dryRun bool
+		added  []string
+	}{
+		{"GET", "", specs, http.StatusMethodNotAllowed, false, nil},
+		{"POST", "?dry_run=maybe", specs, http.StatusBadRequest, false, nil},
+		{"POST", "?dry_run=true", specs, http.StatusOK, true, []string{"test_21_counter"}},
+		{"POST", "", specs, http.StatusOK, false, []string{"test_21_counter"}},
+		{"POST", "", specs, http.StatusOK, false, []string{}},
+		{
+			"POST", "",
+			append(specs, &MetricSpec{Type: "counter", Name: "test_21-invalid", Help: "Invalid"}),
+			http.StatusUnprocessableEntity, false, []string{},
+		},
+	} {
+		specs = tt.specs
+		req := httptest.NewRequest(tt.method, "/-/reload"+tt.query, nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("%s /-/reload%s => status %d, want %d", tt.method, tt.query, rec.Code, tt.status)
+		}
+
+		var r ReloadResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.OK != (tt.status == http.StatusOK) {
+			t.Errorf("%s /-/reload%s => ok %t, want %t", tt.method, tt.query, r.OK, !r.OK)
+		}
+		if r.DryRun != tt.dryRun {
+			t.Errorf("%s /-/reload%s => dry run %t, want %t", tt.method, tt.query, r.DryRun, tt.dryRun)
+		}
+		if tt.added != nil && !sliceEqStr(r.Added, tt.added) {
+			t.Errorf("%s /-/reload%s => added %v, want %v", tt.method, tt.query, r.Added, tt.added)
+		}
+	}
+}
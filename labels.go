@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+func validateLabelDefaults(spec *MetricSpec) error {
+	for label := range spec.LabelDefaults {
+		if !sliceContainsStr(spec.Labels, label) {
+			return fmt.Errorf("Metric %s has default for unknown label %s", spec.Name, label)
+		}
+	}
+
+	return nil
+}
+
+// resolveLabels returns the values of the given labels from the labels
+// map of m, or from the label defaults of spec for those missing from it
+func resolveLabels(spec *MetricSpec, labels []string, m *Metric) ([]string, error) {
+	if len(m.LabelValues) > 0 {
+		return nil, fmt.Errorf("%s: label_values and labels cannot both be given", m.Name)
+	}
+
+	var unknown []string
+	for label := range m.Labels {
+		if !sliceContainsStr(labels, label) {
+			unknown = append(unknown, label)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("%s: unknown labels %v, expected labels are %v", m.Name, unknown, labels)
+	}
+
+	result := make([]string, len(labels))
+	for i, label := range labels {
+		value, ok := m.Labels[label]
+		if !ok {
+			value, ok = spec.LabelDefaults[label]
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s: missing label %s, which has no default", m.Name, label)
+		}
+		result[i] = value
+	}
+
+	return result, nil
+}
+
+// padLabelValues returns the label values of m followed by the defaults
+// of the labels of spec it has no values for, so labels with defaults
+// can be added to the end of a spec before all clients send them
+func padLabelValues(spec *MetricSpec, m *Metric) ([]string, error) {
+	result := append([]string{}, m.LabelValues...)
+
+	for _, label := range spec.Labels[len(m.LabelValues):] {
+		value, ok := spec.LabelDefaults[label]
+		if !ok {
+			return nil, fmt.Errorf("%s: expected %d label values but got %d, and label %s has no default",
+				m.Name, len(spec.Labels), len(m.LabelValues), label)
+		}
+		result = append(result, value)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateLabelDefaults(t *testing.T) {
+	for _, tt := range []struct {
+		spec MetricSpec
+		ok   bool
+	}{
+		{MetricSpec{Name: "test_31_a", Labels: []string{"one"}}, true},
+		{MetricSpec{Name: "test_31_a", Labels: []string{"one"}, LabelDefaults: map[string]string{"one": "a"}}, true},
+		{MetricSpec{Name: "test_31_a", Labels: []string{"one"}, LabelDefaults: map[string]string{"two": "a"}}, false},
+		{MetricSpec{Name: "test_31_a", LabelDefaults: map[string]string{"one": "a"}}, false},
+	} {
+		if err := validateLabelDefaults(&tt.spec); (err == nil) != tt.ok {
+			t.Errorf("validateLabelDefaults(%+v) => %v, want ok %t", tt.spec, err, tt.ok)
+		}
+	}
+}
+
+func TestResolveLabels(t *testing.T) {
+	spec := &MetricSpec{
+		Name:          "test_31_a",
+		Labels:        []string{"method", "code", "region"},
+		LabelDefaults: map[string]string{"region": "us"},
+	}
+
+	for _, tt := range []struct {
+		data   string
+		values []string
+	}{
+		{`{"labels":{"method":"GET","code":"200","region":"eu"}}`, []string{"GET", "200", "eu"}},
+		{`{"labels":{"code":"200","method":"GET"}}`, []string{"GET", "200", "us"}},
+		{`{"labels":{"code":"200","region":""}}`, nil},
+		{`{"labels":{"method":"GET","code":"200","host":"a"}}`, nil},
+		{`{"labels":{"method":"GET","code":"200"},"label_values":["GET","200","us"]}`, nil},
+	} {
+		m := &Metric{}
+		if err := json.Unmarshal([]byte(tt.data), m); err != nil {
+			t.Fatal(err)
+		}
+
+		values, err := resolveLabels(spec, spec.Labels, m)
+		if tt.values == nil {
+			if err == nil {
+				t.Errorf("resolveLabels(%s) => %v, want error", tt.data, values)
+			}
+		} else if err != nil || !sliceEqStr(values, tt.values) {
+			t.Errorf("resolveLabels(%s) => %v %v, want %v", tt.data, values, err, tt.values)
+		}
+	}
+}
+
+func TestHandleLabels(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	spec := &MetricSpec{
+		Type:          "counter",
+		Name:          "test_32_counter",
+		Help:          "Counter",
+		Labels:        []string{"method", "code"},
+		LabelDefaults: map[string]string{"code": "200"},
+	}
+	if err := registry.Register(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := `[
+		{"name":"test_32_counter","method":"inc","label_values":["GET","200"]},
+		{"name":"test_32_counter","method":"inc","labels":{"code":"200","method":"GET"}},
+		{"name":"test_32_counter","method":"inc","labels":{"method":"GET"}},
+		{"name":"test_32_counter","method":"inc","labels":{"method":"POST","code":"500"}},
+		{"name":"test_32_counter","method":"inc","labels":{"code":"500"}},
+		{"name":"test_32_counter","method":"inc","labels":{"method":"GET","path":"/"}}
+	]`
+	result := ProcessBatch(registry, Batch{Data: []byte(batch)})
+	if result.Accepted != 4 || result.Rejected != 2 {
+		t.Errorf("ProcessBatch => %+v, want 4 accepted and 2 rejected", result)
+	}
+
+	for _, tt := range []struct {
+		values []string
+		value  float64
+	}{
+		// gathered label values are ordered by label name
+		{[]string{"200", "GET"}, 3},
+		{[]string{"500", "POST"}, 1},
+	} {
+		if value, _ := gatherValue(t, registry, spec.Name, tt.values...); value != tt.value {
+			t.Errorf("%s%v => %g, want %g", spec.Name, tt.values, value, tt.value)
+		}
+	}
+
+	m := &Metric{Name: spec.Name, Method: methodDelete, admin: true, Labels: map[string]string{"method": "POST", "code": "500"}}
+	if err := registry.Handle(m); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := gatherValue(t, registry, spec.Name, "500", "POST"); found {
+		t.Errorf("%s[POST 500] found after delete", spec.Name)
+	}
+}
+
+func TestPadLabelValues(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	spec := &MetricSpec{
+		Type:          "gauge",
+		Name:          "test_34_gauge",
+		Help:          "Gauge",
+		Labels:        []string{"one", "two", "three"},
+		LabelDefaults: map[string]string{"two": "b", "three": "c"},
+	}
+	if err := registry.Register(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		values []string
+		padded []string
+	}{
+		{[]string{"a", "x", "y"}, []string{"a", "x", "y"}},
+		{[]string{"a", "x"}, []string{"a", "x", "c"}},
+		{[]string{"a"}, []string{"a", "b", "c"}},
+		{[]string{}, nil},
+		{[]string{"a", "x", "y", "z"}, nil},
+	} {
+		m := &Metric{Name: spec.Name, Method: "set", Value: 1, LabelValues: tt.values}
+		err := registry.Handle(m)
+		if tt.padded == nil {
+			if err == nil {
+				t.Errorf("Handle(%v) => nil, want error", tt.values)
+			}
+		} else if err != nil || !hasSeries(registry, spec.Name, tt.padded) {
+			t.Errorf("Handle(%v) => %v, want series %v", tt.values, err, tt.padded)
+		}
+	}
+
+	// series are deleted by the same short label values they are updated by
+	m := &Metric{Name: spec.Name, Method: methodDelete, admin: true, LabelValues: []string{"a"}}
+	if err := registry.Handle(m); err != nil {
+		t.Fatal(err)
+	}
+	if hasSeries(registry, spec.Name, []string{"a", "b", "c"}) {
+		t.Errorf("%s[a b c] found after delete", spec.Name)
+	}
+	if err := registry.Delete(&Metric{Name: spec.Name}); err == nil {
+		t.Errorf("Delete(%s) without label values => nil, want error", spec.Name)
+	}
+}
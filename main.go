@@ -10,6 +10,7 @@ import (
 	"path"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -25,22 +26,114 @@ var (
 
 // cli flags
 var (
-	socketFlag  = flag.String("socket", "/tmp/prom_multi_proc.sock", "Path to unix socket to listen on for incoming metrics")
-	metricsFlag = flag.String("metrics", "", "Path to json file which contains metric definitions")
-	addrFlag    = flag.String("addr", "0.0.0.0:9299", "Address to listen on for exposing prometheus metrics")
-	pathFlag    = flag.String("path", "/metrics", "Path to use for exposing prometheus metrics")
-	logFlag     = flag.String("log", "", "Path to log file, will write to STDOUT if empty")
-	versionFlag = flag.Bool("v", false, "Print version information and exit")
+	socketFlag      = flag.String("socket", "/tmp/prom_multi_proc.sock", "Path to unix socket to listen on for incoming metrics")
+	framingFlag     = flag.String("framing", FramingNone, "Framing of batches on socket connections: none (one batch per connection), newline or length (4 byte big-endian prefix)")
+	ackFlag         = flag.Bool("ack", false, "Process batches on socket connections synchronously and write back a json result for each one")
+	dgramSocketFlag = flag.String("dgram-socket", "", "Path to unixgram socket to listen on for incoming metrics, disabled if empty")
+	udpAddrFlag     = flag.String("udp-addr", "", "Address to listen on for incoming metrics over udp, disabled if empty")
+	statsdAddrFlag  = flag.String("statsd-addr", "", "Address to listen on for incoming statsd metrics over udp, disabled if empty")
+	reapFlag        = flag.Duration("reap-interval", 30*time.Second, "Interval at which to remove state belonging to dead processes, disabled if 0")
+	namespaceFlag   = flag.String("namespace", "", "Namespace to prefix the names of all metrics which do not set one with when exporting them")
+	maxSeriesFlag   = flag.Int("max-series", 0, "Maximum number of series of each metric with labels which does not set max_series, unlimited if 0")
+	expireFlag      = flag.Duration("expire-interval", 10*time.Second, "Interval at which to remove series which have not been updated within the ttl of their metric, disabled if 0")
+	metricsFlag     = flag.String("metrics", "", "Path to json, yaml or toml file which contains metric definitions, or a directory or glob pattern of such files")
+	formatFlag      = flag.String("metrics-format", "", "Format of metric definition files: json, yaml or toml, by file extension if empty")
+	watchFlag       = flag.Duration("watch", 0, "Interval at which to check the metrics definitions for changes and reload it, disabled if 0")
+	reloadStateFlag = flag.String("reload-state", "carry", "State of metrics whose definition changes on reload: carry (keep values of metrics with unchanged labels, buckets and objectives) or reset")
+	autoRegFlag     = flag.String("auto-register", "", "Path to json file which contains templates for automatically registering unknown metrics, disabled if empty")
+	autoRegMaxFlag  = flag.Int("auto-register-max", 100, "Maximum number of metrics to register automatically")
+	addrFlag        = flag.String("addr", "0.0.0.0:9299", "Address to listen on for exposing prometheus metrics")
+	pathFlag        = flag.String("path", "/metrics", "Path to use for exposing prometheus metrics")
+	ingestPathFlag  = flag.String("ingest-path", "", "Path to use for accepting metrics over http, disabled if empty")
+	adminPathFlag   = flag.String("admin-path", "", "Path prefix to use for deleting series and resetting metrics over http, disabled if empty")
+	apiPathFlag     = flag.String("api-path", "/api/v1", "Path prefix to use for the read-only json api listing metric specs and series, disabled if empty")
+	reloadPathFlag  = flag.String("reload-path", "/-/reload", "Path to use for reloading metric definitions over http, disabled if empty")
+	logFlag         = flag.String("log", "", "Path to log file, will write to STDOUT if empty")
+	versionFlag     = flag.Bool("v", false, "Print version information and exit")
 )
 
+// cleanups are run before the process exits
+var cleanups []func()
+
+func cleanup() {
+	for _, fn := range cleanups {
+		fn()
+	}
+}
+
 func init() {
+	flag.Var(labelsFlag(globalLabels), "label", "Constant label of the form key=value to add to every defined metric, but not those of prom_multi_proc itself, may be repeated, environment variables like $HOSTNAME in the value are expanded")
+
 	prometheus.MustRegister(metricsTotal)
+	prometheus.MustRegister(datagramsDropped)
+	prometheus.MustRegister(expiredTotal)
+	prometheus.MustRegister(rejectedSeriesTotal)
+
+	flag.Usage = func() {
+		name := path.Base(os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", name)
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [options]\n", name)
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [options] validate [path ...]\n", name)
+		fmt.Fprintln(flag.CommandLine.Output(), "Options:")
+		flag.PrintDefaults()
+	}
 }
 
 func versionStr() string {
 	return fmt.Sprintf("%s %s %s %s %s", path.Base(os.Args[0]), Version, BuildTime, BuildHash, GoVersion)
 }
 
+// validateCmd validates the metric definitions at each of paths, or at
+// the metrics flag if none are given, and returns the exit code
+func validateCmd(paths []string) int {
+	if len(paths) == 0 {
+		if *metricsFlag == "" {
+			fmt.Fprintln(os.Stderr, "No metric definitions to validate")
+			return 2
+		}
+		paths = []string{*metricsFlag}
+	}
+
+	var n int
+	for _, p := range paths {
+		n += ValidateSpecs(os.Stdout, p, *formatFlag)
+	}
+
+	if n > 0 {
+		fmt.Fprintf(os.Stderr, "%d problems found\n", n)
+		return 1
+	}
+
+	return 0
+}
+
+// reload loads the templates and metric definitions and applies them to
+// registry, or only reports what would change if dryRun is true
+func reload(registry Registry, dryRun bool) *ReloadResult {
+	// reload templates for automatically registered metrics
+	if *autoRegFlag != "" && !dryRun {
+		templates, err := LoadTemplates(*autoRegFlag)
+		if err != nil {
+			logger.Printf("Error loading auto-registration templates: %s", err)
+		} else {
+			registry.SetTemplates(templates, *autoRegMaxFlag)
+		}
+	}
+
+	// reload metrics definitions file, only register/unregister if there
+	// is no error processing it
+	var result *ReloadResult
+	specs, err := LoadSpecs(*metricsFlag, *formatFlag)
+	if err != nil {
+		result = &ReloadResult{DryRun: dryRun, Error: err.Error()}
+	} else {
+		result = Reload(registry, specs, *reloadStateFlag == "carry", dryRun)
+	}
+
+	result.Log()
+	return result
+}
+
 func main() {
 	flag.Parse()
 
@@ -56,30 +149,117 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := ValidateFraming(*framingFlag); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := ValidateFormat(*formatFlag); err != nil {
+		logger.Fatal(err)
+	}
+
+	if *namespaceFlag != "" {
+		if err := validateMetric(*namespaceFlag); err != nil {
+			logger.Fatalf("Invalid namespace: %s", err)
+		}
+	}
+	defaultNamespace = *namespaceFlag
+
+	if *maxSeriesFlag < 0 {
+		logger.Fatalf("Invalid max series %d", *maxSeriesFlag)
+	}
+	defaultMaxSeries = *maxSeriesFlag
+
+	if !sliceContainsStr(reloadStates, *reloadStateFlag) {
+		logger.Fatalf("Unknown reload state %s", *reloadStateFlag)
+	}
+
+	if flag.Arg(0) == "validate" {
+		os.Exit(validateCmd(flag.Args()[1:]))
+	}
+
 	// setup metrics and done channels
 	metricCh := make(chan Metric)
-	dataCh := make(chan []byte)
+	// buffered so datagram readers only drop batches in bursts which the
+	// parsers cannot keep up with
+	dataCh := make(chan Batch, dataBufferSize)
 	doneCh := make(chan bool)
 
+	// reloads are requested on reloadCh, with a channel for the result
+	// unless nobody is waiting for it
+	reloadCh := make(chan chan *ReloadResult)
+	replyCh := make(chan chan *ReloadResult)
+	go func() {
+		for reply := range reloadCh {
+			// stop the data processor and hand the reply to the reload loop
+			doneCh <- true
+			replyCh <- reply
+		}
+	}()
+
 	// begin listening on socket
 	ln, err := net.Listen("unix", *socketFlag)
 	if err != nil {
 		logger.Fatal(err)
 	}
-	defer ln.Close()
+	cleanups = append(cleanups, func() { ln.Close() })
+	defer cleanup()
 
 	err = os.Chmod(*socketFlag, 0777)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
+	// optionally listen for datagrams on a unixgram socket
+	var dgramConn net.PacketConn
+	if *dgramSocketFlag != "" {
+		dgramConn, err = net.ListenPacket("unixgram", *dgramSocketFlag)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		// unlike stream listeners, unixgram sockets are not unlinked on close
+		cleanups = append(cleanups, func() {
+			dgramConn.Close()
+			os.Remove(*dgramSocketFlag)
+		})
+
+		err = os.Chmod(*dgramSocketFlag, 0777)
+		if err != nil {
+			cleanup()
+			logger.Fatal(err)
+		}
+	}
+
+	// optionally listen for datagrams on udp
+	var udpConn net.PacketConn
+	if *udpAddrFlag != "" {
+		udpConn, err = net.ListenPacket("udp", *udpAddrFlag)
+		if err != nil {
+			cleanup()
+			logger.Fatal(err)
+		}
+		cleanups = append(cleanups, func() { udpConn.Close() })
+	}
+
+	// optionally listen for statsd datagrams on udp
+	var statsdConn net.PacketConn
+	if *statsdAddrFlag != "" {
+		statsdConn, err = net.ListenPacket("udp", *statsdAddrFlag)
+		if err != nil {
+			cleanup()
+			logger.Fatal(err)
+		}
+		cleanups = append(cleanups, func() { statsdConn.Close() })
+	}
+
+	registry := NewRegistry()
+
 	// listen for signals which make us quit
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL)
 	go func() {
 		<-sigc
 		logger.Println("Goodbye!")
-		ln.Close()
+		cleanup()
 		os.Exit(0)
 	}()
 
@@ -90,19 +270,36 @@ func main() {
 		for {
 			<-sigu
 			logger.Println("USR1 Signal received")
-			// stop the data processor
-			doneCh <- true
+			reloadCh <- nil
 		}
 	}()
 
-	registry := NewRegistry()
+	// listen for USR2 signal which makes us report what reloading our
+	// metrics definitions would do, without doing it
+	sigd := make(chan os.Signal, 1)
+	signal.Notify(sigd, syscall.SIGUSR2)
+	go func() {
+		for {
+			<-sigd
+			logger.Println("USR2 Signal received")
+			reload(registry, true)
+		}
+	}()
+
+	// optionally reload our metrics definitions when they change
+	if *watchFlag > 0 {
+		go WatchFile(*metricsFlag, *watchFlag, func(change string) {
+			logger.Printf("Metrics changed: %s", change)
+			reloadCh <- nil
+		})
+	}
 
 	go func() {
 		defer func() {
 			// recover a panic here to make sure socket gets cleaned up
 			if r := recover(); r != nil {
 				logger.Printf("Recovered panic: %s", r)
-				ln.Close()
+				cleanup()
 				os.Exit(1)
 			}
 		}()
@@ -110,49 +307,20 @@ func main() {
 		// exit the process, in other words, never break;
 		// otherwise data processing will stop and USR1
 		// signals will not reload the metrics definition json
+		var reply chan *ReloadResult
 		for {
 			logger.Println(versionStr())
 			logger.Println("Loading metric configuration")
 
-			// note beginning names of metrics
-			names := registry.Names()
-
-			// reload metrics definitions file
-			specs, err := LoadSpecs(*metricsFlag)
-			if err != nil {
-				logger.Printf("Error loading configuration: %s", err)
-			} else {
-				// only register/unregister if there is no error processing
-				// the metrics definition json
-				newNames := []string{}
-				for _, spec := range specs {
-					newNames = append(newNames, spec.Name)
-					if err := registry.Register(spec); err != nil {
-						logger.Println(err)
-					} else {
-						logger.Printf("Registered %s", spec.Name)
-					}
-				}
-
-				// get names of metrics no longer present and unregister them
-				unreg := sliceSubStr(names, newNames)
-				for _, name := range unreg {
-					if err := registry.Unregister(name); err != nil {
-						logger.Println(err)
-					} else {
-						logger.Printf("Unregistered %s", name)
-					}
-				}
+			result := reload(registry, false)
+			if reply != nil {
+				reply <- result
 			}
 
 			// begin processing incoming metrics
 			DataProcessor(registry, metricCh, doneCh)
+			reply = <-replyCh
 		}
-
-		// Ensure this process ends if we ever return from the for loop.
-		logger.Println("Data processing has ended")
-		ln.Close()
-		os.Exit(1)
 	}()
 
 	// listen for HUP signal which makes us reopen our log file descriptors
@@ -165,23 +333,67 @@ func main() {
 			err := SetLogger(*logFlag)
 			if err != nil {
 				fmt.Println(err)
-				ln.Close()
+				cleanup()
 				os.Exit(1)
 			}
 		}
 	}()
 
+	if *reapFlag > 0 {
+		go PidReaper(registry, *reapFlag)
+	}
+
+	if *expireFlag > 0 {
+		go SeriesExpirer(registry, *expireFlag)
+	}
+
 	workers := runtime.NumCPU()
 	for i := 0; i < workers; i++ {
 		go DataParser(dataCh, metricCh)
 	}
 
-	go DataReader(ln, dataCh)
+	if *ackFlag {
+		go DataReader(ln, *framingFlag, AckFrames(registry))
+	} else {
+		go DataReader(ln, *framingFlag, QueueFrames(dataCh))
+	}
+	if dgramConn != nil {
+		go DatagramReader(dgramConn, dataCh)
+	}
+	if udpConn != nil {
+		go DatagramReader(udpConn, dataCh)
+	}
+	if statsdConn != nil {
+		go StatsdReader(statsdConn, registry, metricCh)
+	}
 
 	// setup prometheus http handlers and begin listening
-	promHandler := promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	promHandler := promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{
 		ErrorLog: logger,
 	})
 	http.Handle(*pathFlag, promHandler)
+	if *ingestPathFlag != "" {
+		http.Handle(*ingestPathFlag, IngestHandler(registry))
+	}
+	if *apiPathFlag != "" {
+		http.Handle(*apiPathFlag+"/specs", SpecsHandler(registry))
+		http.Handle(*apiPathFlag+"/series", SeriesHandler(registry))
+	}
+	if *adminPathFlag != "" {
+		http.Handle(*adminPathFlag+"/delete", AdminHandler(registry, methodDelete))
+		http.Handle(*adminPathFlag+"/reset", AdminHandler(registry, methodReset))
+	}
+	if *reloadPathFlag != "" {
+		http.Handle(*reloadPathFlag, ReloadHandler(func(dryRun bool) *ReloadResult {
+			logger.Println("Reload requested over http")
+			if dryRun {
+				return reload(registry, true)
+			}
+			reply := make(chan *ReloadResult, 1)
+			reloadCh <- reply
+			return <-reply
+		}))
+	}
 	http.ListenAndServe(*addrFlag, nil)
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// multiprocess modes for gauges, see
+// https://github.com/prometheus/client_python#multiprocess-mode-eg-gunicorn
+var multiprocessModes = []string{
+	// a single value shared by all processes, the default
+	"last",
+	// one series per process, labeled by pid
+	"all",
+	// one series per live process, labeled by pid
+	"liveall",
+	// the sum of the values of all processes
+	"sum",
+	// the sum of the values of all live processes
+	"livesum",
+	// the maximum value of all processes
+	"max",
+	// the minimum value of all processes
+	"min",
+}
+
+// label added to gauges with multiprocess mode all or liveall
+const pidLabel = "pid"
+
+func validateMultiprocessMode(spec *MetricSpec) error {
+	if spec.MultiprocessMode == "" {
+		return nil
+	}
+
+	if spec.Type != "gauge" {
+		return fmt.Errorf("Metric %s has multiprocess_mode, but only gauges support it", spec.Name)
+	}
+
+	if !sliceContainsStr(multiprocessModes, spec.MultiprocessMode) {
+		return fmt.Errorf("Metric %s has unknown multiprocess_mode %s", spec.Name, spec.MultiprocessMode)
+	}
+
+	if isPerProcessMode(spec.MultiprocessMode) && sliceContainsStr(spec.labelNames(), pidLabel) {
+		return fmt.Errorf("Metric %s cannot have label %s with multiprocess_mode %s", spec.Name, pidLabel, spec.MultiprocessMode)
+	}
+
+	return nil
+}
+
+// isMultiprocessMode is true for modes which keep a value per process
+func isMultiprocessMode(mode string) bool {
+	return mode != "" && mode != "last"
+}
+
+// isPerProcessMode is true for modes which export a series per process
+func isPerProcessMode(mode string) bool {
+	return mode == "all" || mode == "liveall"
+}
+
+// isLiveMode is true for modes which ignore the values of dead processes
+func isLiveMode(mode string) bool {
+	return strings.HasPrefix(mode, "live")
+}
+
+// pidAlive reports whether a process with the given pid exists. The
+// unknown pid 0 is always considered alive.
+func pidAlive(pid int) bool {
+	if pid <= 0 {
+		return true
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+type gaugeSeries struct {
+	labelValues []string
+	pids        map[int]float64
+	updated     time.Time
+}
+
+// MultiprocGaugeHandler keeps a gauge value for each sending process,
+// identified by the pid of the metric, and aggregates them according to
+// the multiprocess mode of its spec when collected
+type MultiprocGaugeHandler struct {
+	spec   *MetricSpec
+	desc   *prometheus.Desc
+	series map[string]*gaugeSeries
+	mu     sync.Mutex
+}
+
+func NewMultiprocGaugeHandler(spec *MetricSpec) *MultiprocGaugeHandler {
+	labels := spec.labelNames()
+	if isPerProcessMode(spec.MultiprocessMode) {
+		labels = append(append([]string{}, labels...), pidLabel)
+	}
+
+	return &MultiprocGaugeHandler{
+		spec:   spec,
+		desc:   prometheus.NewDesc(spec.fqName(), spec.Help, labels, spec.constLabels()),
+		series: make(map[string]*gaugeSeries),
+	}
+}
+
+func (h *MultiprocGaugeHandler) Spec() *MetricSpec {
+	return h.spec
+}
+
+func (h *MultiprocGaugeHandler) Handle(m *Metric) error {
+	// check before the series is created
+	if err := checkMethod("gauge", m); err != nil {
+		return err
+	}
+
+	if n := len(h.spec.labelNames()); len(m.LabelValues) != n {
+		return fmt.Errorf("%s: expected %d label values but got %d", m.Name, n, len(m.LabelValues))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	labelValues := m.LabelValues
+	key := strings.Join(labelValues, "\xff")
+	series, ok := h.series[key]
+
+	// the series folded into does not count against the limit
+	n := len(h.series)
+	if _, folded := h.series[overflowKey(len(labelValues))]; folded {
+		n--
+	}
+
+	if !ok && h.spec.maxSeries() > 0 && n >= h.spec.maxSeries() {
+		var err error
+		labelValues, err = overflowLabelValues(m.Name, h.spec.overflow(), labelValues)
+		if err != nil {
+			return err
+		}
+		key = strings.Join(labelValues, "\xff")
+		series, ok = h.series[key]
+	}
+	if !ok {
+		series = &gaugeSeries{
+			labelValues: append([]string{}, labelValues...),
+			pids:        make(map[int]float64),
+		}
+		h.series[key] = series
+	}
+
+	value := series.pids[m.Pid]
+	switch m.Method {
+	default:
+		return checkMethod("gauge", m)
+	case "set":
+		value = m.Value
+	case "inc":
+		value++
+	case "dec":
+		value--
+	case "add":
+		value += m.Value
+	case "sub":
+		value -= m.Value
+	case "set_to_current_time":
+		value = float64(time.Now().UnixNano()) / 1e9
+	}
+	series.pids[m.Pid] = value
+	series.updated = time.Now()
+
+	return nil
+}
+
+func (h *MultiprocGaugeHandler) Collector() prometheus.Collector {
+	return h
+}
+
+func (h *MultiprocGaugeHandler) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+func (h *MultiprocGaugeHandler) Collect(ch chan<- prometheus.Metric) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	mode := h.spec.MultiprocessMode
+	live := isLiveMode(mode)
+
+	for _, series := range h.series {
+		var (
+			result float64
+			count  int
+		)
+		for pid, value := range series.pids {
+			if live && !pidAlive(pid) {
+				continue
+			}
+
+			if isPerProcessMode(mode) {
+				labelValues := append(append([]string{}, series.labelValues...), strconv.Itoa(pid))
+				ch <- prometheus.MustNewConstMetric(h.desc, prometheus.GaugeValue, value, labelValues...)
+				continue
+			}
+
+			switch {
+			case count == 0:
+				result = value
+			case mode == "sum" || mode == "livesum":
+				result += value
+			case mode == "max":
+				result = math.Max(result, value)
+			case mode == "min":
+				result = math.Min(result, value)
+			}
+			count++
+		}
+
+		if count > 0 {
+			ch <- prometheus.MustNewConstMetric(h.desc, prometheus.GaugeValue, result, series.labelValues...)
+		}
+	}
+}
+
+// copySeries returns a copy of the series of h, which the old handler may
+// still be collecting from while a new one updates its own
+func (h *MultiprocGaugeHandler) copySeries() map[string]*gaugeSeries {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := make(map[string]*gaugeSeries, len(h.series))
+	for key, series := range h.series {
+		pids := make(map[int]float64, len(series.pids))
+		for pid, value := range series.pids {
+			pids[pid] = value
+		}
+		result[key] = &gaugeSeries{
+			labelValues: series.labelValues,
+			pids:        pids,
+			updated:     series.updated,
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// collectValues collects c and returns the gauge or counter value of each
+// series, keyed by its comma separated label values
+func collectValues(t *testing.T, c prometheus.Collector) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	result := make(map[string]float64)
+	for metric := range ch {
+		var m dto.Metric
+		if err := metric.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		var labelValues []string
+		for _, pair := range m.GetLabel() {
+			labelValues = append(labelValues, pair.GetValue())
+		}
+		key := strings.Join(labelValues, ",")
+		if m.Gauge != nil {
+			result[key] = m.GetGauge().GetValue()
+		} else if m.Counter != nil {
+			result[key] = m.GetCounter().GetValue()
+		}
+	}
+
+	return result
+}
+
+// deadPid returns the pid of a process which has exited
+func deadPid(t *testing.T) int {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestMultiprocGauge(t *testing.T) {
+	SetTestLogger()
+
+	alive := os.Getpid()
+	dead := deadPid(t)
+
+	for i, tt := range []struct {
+		mode string
+		r    map[string]float64
+	}{
+		{"all", map[string]float64{
+			fmt.Sprintf("a,%d", alive): 3,
+			fmt.Sprintf("a,%d", dead):  5,
+			fmt.Sprintf("b,%d", alive): 1,
+		}},
+		{"liveall", map[string]float64{
+			fmt.Sprintf("a,%d", alive): 3,
+			fmt.Sprintf("b,%d", alive): 1,
+		}},
+		{"sum", map[string]float64{"a": 8, "b": 1}},
+		{"livesum", map[string]float64{"a": 3, "b": 1}},
+		{"max", map[string]float64{"a": 5, "b": 1}},
+		{"min", map[string]float64{"a": 3, "b": 1}},
+	} {
+		spec := &MetricSpec{
+			Type:             "gauge",
+			Name:             fmt.Sprintf("test_11_gauge_%d", i),
+			Help:             "Test 11 gauge",
+			Labels:           []string{"one"},
+			MultiprocessMode: tt.mode,
+		}
+
+		registry := NewRegistry()
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, m := range []Metric{
+			{Name: spec.Name, LabelValues: []string{"a"}, Method: "set", Value: 2, Pid: alive},
+			{Name: spec.Name, LabelValues: []string{"a"}, Method: "inc", Pid: alive},
+			{Name: spec.Name, LabelValues: []string{"a"}, Method: "add", Value: 5, Pid: dead},
+			{Name: spec.Name, LabelValues: []string{"b"}, Method: "set", Value: 1, Pid: alive},
+		} {
+			if err := registry.Handle(&m); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := registry.Handle(&Metric{Name: spec.Name, Method: "set", Pid: alive}); err == nil {
+			t.Errorf("Expected label value mismatch for mode %s to throw error, but did not", tt.mode)
+		}
+
+		handler := registry.(*ireg).Handlers[spec.Name]
+		r := collectValues(t, handler.Collector())
+		if len(r) != len(tt.r) {
+			t.Errorf("Mode %s => %v, want %v", tt.mode, r, tt.r)
+			continue
+		}
+		for key, value := range tt.r {
+			if r[key] != value {
+				t.Errorf("Mode %s => %v, want %v", tt.mode, r, tt.r)
+				break
+			}
+		}
+
+		if err := registry.Unregister(spec.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestValidateMultiprocessMode(t *testing.T) {
+	for _, tt := range []struct {
+		spec MetricSpec
+		err  bool
+	}{
+		{MetricSpec{Type: "gauge"}, false},
+		{MetricSpec{Type: "gauge", MultiprocessMode: "last"}, false},
+		{MetricSpec{Type: "gauge", MultiprocessMode: "livesum"}, false},
+		{MetricSpec{Type: "gauge", MultiprocessMode: "liveall", Labels: []string{"one"}}, false},
+		{MetricSpec{Type: "gauge", MultiprocessMode: "bogus"}, true},
+		{MetricSpec{Type: "counter", MultiprocessMode: "sum"}, true},
+		{MetricSpec{Type: "gauge", MultiprocessMode: "all", Labels: []string{"pid"}}, true},
+		{MetricSpec{Type: "gauge", MultiprocessMode: "max", Labels: []string{"pid"}}, false},
+	} {
+		err := validateMultiprocessMode(&tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("validateMultiprocessMode(%+v) => %v, want error %t", tt.spec, err, tt.err)
+		}
+	}
+}
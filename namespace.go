@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultNamespace is the namespace of specs which do not set one
+var defaultNamespace string
+
+// namespace returns the namespace of the spec, or the default namespace
+// if it has none
+func (spec *MetricSpec) namespace() string {
+	if spec.Namespace != "" {
+		return spec.Namespace
+	}
+	return defaultNamespace
+}
+
+// fqName returns the name under which the metric of the spec is exported,
+// its name prefixed by its namespace and subsystem. Metrics are still
+// sent and looked up by their name alone.
+func (spec *MetricSpec) fqName() string {
+	return prometheus.BuildFQName(spec.namespace(), spec.Subsystem, spec.Name)
+}
+
+func validateNamespace(spec *MetricSpec) error {
+	if spec.namespace() == "" && spec.Subsystem == "" {
+		return nil
+	}
+
+	if !metricRe.MatchString(spec.fqName()) {
+		return fmt.Errorf("Metric %s has namespace '%s' and subsystem '%s', which make its name '%s' not valid",
+			spec.Name, spec.namespace(), spec.Subsystem, spec.fqName())
+	}
+
+	return nil
+}
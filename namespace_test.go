@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFqName(t *testing.T) {
+	defer func() { defaultNamespace = "" }()
+
+	for _, tt := range []struct {
+		def  string
+		spec MetricSpec
+		name string
+		ok   bool
+	}{
+		{"", MetricSpec{Name: "jobs_total"}, "jobs_total", true},
+		{"", MetricSpec{Name: "jobs_total", Namespace: "app"}, "app_jobs_total", true},
+		{"", MetricSpec{Name: "jobs_total", Subsystem: "worker"}, "worker_jobs_total", true},
+		{"", MetricSpec{Name: "jobs_total", Namespace: "app", Subsystem: "worker"}, "app_worker_jobs_total", true},
+		{"web", MetricSpec{Name: "jobs_total"}, "web_jobs_total", true},
+		{"web", MetricSpec{Name: "jobs_total", Subsystem: "worker"}, "web_worker_jobs_total", true},
+		{"web", MetricSpec{Name: "jobs_total", Namespace: "app"}, "app_jobs_total", true},
+		{"", MetricSpec{Name: "jobs_total", Namespace: "my-app"}, "my-app_jobs_total", false},
+		{"", MetricSpec{Name: "jobs_total", Namespace: "1app"}, "1app_jobs_total", false},
+		{"", MetricSpec{Name: "jobs_total", Subsystem: "a.b"}, "a.b_jobs_total", false},
+	} {
+		defaultNamespace = tt.def
+		if name := tt.spec.fqName(); name != tt.name {
+			t.Errorf("fqName(%+v) with default %q => %s, want %s", tt.spec, tt.def, name, tt.name)
+		}
+		if err := validateNamespace(&tt.spec); (err == nil) != tt.ok {
+			t.Errorf("validateNamespace(%+v) with default %q => %v, want ok %t", tt.spec, tt.def, err, tt.ok)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	SetTestLogger()
+
+	defaultNamespace = "test_37"
+	defer func() { defaultNamespace = "" }()
+
+	registry := NewRegistry()
+	for _, spec := range []*MetricSpec{
+		{Type: "counter", Name: "counter", Help: "Counter"},
+		{Type: "counter", Name: "vec", Help: "Vec", Subsystem: "sub", Labels: []string{"one"}},
+		{Type: "gauge", Name: "multi", Help: "Multi", Namespace: "test_37_own", MultiprocessMode: "sum"},
+	} {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// metrics are sent by their unprefixed name
+	for _, m := range []*Metric{
+		{Name: "counter", Method: "inc"},
+		{Name: "vec", Method: "inc", LabelValues: []string{"a"}},
+		{Name: "multi", Method: "set", Value: 3, Pid: 1},
+	} {
+		if err := registry.Handle(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.Handle(&Metric{Name: "test_37_counter", Method: "inc"}); err == nil {
+		t.Errorf("Handle(test_37_counter) => nil, want error for prefixed name")
+	}
+
+	for _, tt := range []struct {
+		name   string
+		values []string
+		value  float64
+	}{
+		{"test_37_counter", nil, 1},
+		{"test_37_sub_vec", []string{"a"}, 1},
+		{"test_37_own_multi", nil, 3},
+	} {
+		if value, found := gatherValue(t, registry, tt.name, tt.values...); !found || value != tt.value {
+			t.Errorf("%s%v => %g %t, want %g", tt.name, tt.values, value, found, tt.value)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// labels describing the sender which a spec may have appended to its labels
+var peerLabels = []string{
+	// pid of the sending process
+	"pid",
+	// uid of the sending process
+	"uid",
+	// name of the sending process, from /proc/<pid>/comm
+	"process_name",
+}
+
+// Peer identifies the process which sent a batch of metrics
+type Peer struct {
+	Pid int
+	Uid int
+	Gid int
+
+	// command name of the process, looked up by pid when empty
+	Name string
+}
+
+// apply identifies m as sent by p, unless it names its sender explicitly
+func (p *Peer) apply(m *Metric) {
+	if p == nil {
+		return
+	}
+	m.peer = p
+	if m.Pid == 0 {
+		m.Pid = p.Pid
+	}
+}
+
+// processName returns the command name of the process with the given
+// pid, or an empty string if it cannot be determined
+func processName(pid int) string {
+	if pid <= 0 {
+		return ""
+	}
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// how long process names are cached, since pids are reused and names
+// change on exec
+const processNameTTL = time.Minute
+
+type cachedName struct {
+	name    string
+	expires time.Time
+}
+
+// cache of process names by pid, so /proc is not read for every metric
+var processNames = struct {
+	sync.Mutex
+	names map[int]cachedName
+}{names: make(map[int]cachedName)}
+
+// cachedProcessName is processName, cached for processNameTTL
+func cachedProcessName(pid int) string {
+	processNames.Lock()
+	defer processNames.Unlock()
+
+	now := time.Now()
+	if c, ok := processNames.names[pid]; ok && now.Before(c.expires) {
+		return c.name
+	}
+
+	// drop expired names once there are many, so the cache does not grow
+	// with every pid ever seen
+	if len(processNames.names) >= 1024 {
+		for p, c := range processNames.names {
+			if !now.Before(c.expires) {
+				delete(processNames.names, p)
+			}
+		}
+	}
+
+	name := processName(pid)
+	processNames.names[pid] = cachedName{name, now.Add(processNameTTL)}
+	return name
+}
+
+func validatePeerLabels(spec *MetricSpec) error {
+	for _, label := range spec.PeerLabels {
+		if !sliceContainsStr(peerLabels, label) {
+			return fmt.Errorf("Metric %s has unknown peer label %s", spec.Name, label)
+		}
+	}
+
+	return nil
+}
+
+// appendPeerLabelValues returns the label values of m followed by the
+// values of the peer labels of spec, which are empty when unknown
+func appendPeerLabelValues(spec *MetricSpec, m *Metric) []string {
+	result := make([]string, 0, len(m.LabelValues)+len(spec.PeerLabels))
+	result = append(result, m.LabelValues...)
+
+	for _, label := range spec.PeerLabels {
+		var value string
+		switch label {
+		case "pid":
+			if m.Pid > 0 {
+				value = strconv.Itoa(m.Pid)
+			}
+		case "uid":
+			if m.peer != nil {
+				value = strconv.Itoa(m.peer.Uid)
+			}
+		case "process_name":
+			if m.peer != nil && m.peer.Pid == m.Pid && m.peer.Name != "" {
+				value = m.peer.Name
+			} else {
+				value = cachedProcessName(m.Pid)
+			}
+		}
+		result = append(result, value)
+	}
+
+	return result
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestPeerLabels(t *testing.T) {
+	SetTestLogger()
+
+	spec := &MetricSpec{
+		Type:       "counter",
+		Name:       "test_13_counter_vec",
+		Help:       "Test 13 counter vector",
+		Labels:     []string{"one"},
+		PeerLabels: []string{"pid", "uid", "process_name"},
+	}
+
+	registry := NewRegistry()
+	if err := registry.Register(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	pid := os.Getpid()
+	peer := &Peer{Pid: pid, Uid: 1000, Name: "worker"}
+
+	for _, tt := range []struct {
+		m    Metric
+		peer *Peer
+		r    []string
+	}{
+		{Metric{LabelValues: []string{"a"}}, peer, []string{"a", strconv.Itoa(pid), "1000", "worker"}},
+		{Metric{LabelValues: []string{"a"}}, nil, []string{"a", "", "", ""}},
+		{Metric{LabelValues: []string{"a"}, Pid: 12}, peer, []string{"a", "12", "1000", processName(12)}},
+		{Metric{LabelValues: []string{"a"}, Pid: pid}, nil, []string{"a", strconv.Itoa(pid), "", processName(pid)}},
+		{Metric{LabelValues: []string{"b"}}, &Peer{Pid: pid, Uid: 1000}, []string{"b", strconv.Itoa(pid), "1000", processName(pid)}},
+	} {
+		m := tt.m
+		m.Name = spec.Name
+		m.Method = "inc"
+		tt.peer.apply(&m)
+
+		if err := registry.Handle(&m); err != nil {
+			t.Fatal(err)
+		}
+		if !hasSeries(registry, spec.Name, tt.r) {
+			t.Errorf("Peer labels of %+v from %+v => %v, want %v", tt.m, tt.peer, collectSeries(registry.(*ireg).Handlers[spec.Name].(VecHandler)), tt.r)
+		}
+		if !sliceEqStr(m.LabelValues, tt.m.LabelValues) {
+			t.Errorf("Handle changed label values of %+v to %v", tt.m, m.LabelValues)
+		}
+	}
+
+	// peer label values must not be sent by the client
+	m := Metric{Name: spec.Name, Method: "inc", LabelValues: []string{"a", "1"}}
+	if err := registry.Handle(&m); err == nil {
+		t.Fatal("Expected extra label values to throw error, but did not")
+	}
+}
+
+func TestProcessName(t *testing.T) {
+	if _, err := os.Stat(fmt.Sprintf("/proc/%d/comm", os.Getpid())); err != nil {
+		t.Skip("/proc is not available")
+	}
+	if name := processName(os.Getpid()); name == "" {
+		t.Fatal("Expected name of current process, but got none")
+	}
+	if name := processName(deadPid(t)); name != "" {
+		t.Fatalf("Expected no name for dead process, but got %s", name)
+	}
+}
+
+func TestValidatePeerLabels(t *testing.T) {
+	for _, tt := range []struct {
+		spec MetricSpec
+		err  bool
+	}{
+		{MetricSpec{}, false},
+		{MetricSpec{PeerLabels: []string{"pid", "uid", "process_name"}}, false},
+		{MetricSpec{PeerLabels: []string{"gid"}}, true},
+	} {
+		err := validatePeerLabels(&tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("validatePeerLabels(%+v) => %v, want error %t", tt.spec, err, tt.err)
+		}
+	}
+
+	// peer labels may not duplicate the labels of the spec
+	spec := &MetricSpec{
+		Type:       "gauge",
+		Name:       "test_13_gauge_vec",
+		Help:       "Test 13 gauge vector",
+		Labels:     []string{"pid"},
+		PeerLabels: []string{"pid"},
+	}
+	if _, err := buildHandler(spec); err == nil {
+		t.Fatal("Expected duplicate peer label to throw error, but did not")
+	}
+}
@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// PeerCred returns the credentials of the process on the other end of
+// a unix socket connection, as reported by SO_PEERCRED
+func PeerCred(c net.Conn) (*Peer, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("peer credentials are only available for unix connections")
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		ucred *syscall.Ucred
+		cerr  error
+	)
+	err = raw.Control(func(fd uintptr) {
+		ucred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cerr != nil {
+		return nil, cerr
+	}
+
+	return &Peer{
+		Pid: int(ucred.Pid),
+		Uid: int(ucred.Uid),
+		Gid: int(ucred.Gid),
+	}, nil
+}
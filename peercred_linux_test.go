@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerCred(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prom_multi_proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "peercred.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	peer, err := PeerCred(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Pid != os.Getpid() || peer.Uid != os.Getuid() || peer.Gid != os.Getgid() {
+		t.Fatalf("PeerCred => %+v, want pid %d uid %d gid %d", peer, os.Getpid(), os.Getuid(), os.Getgid())
+	}
+}
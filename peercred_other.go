@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// PeerCred is not supported on this platform
+func PeerCred(c net.Conn) (*Peer, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
@@ -1,18 +1,44 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// maximum size of a single datagram, larger datagrams are truncated
+const maxDatagramSize = 65536
+
+// number of batches which may wait for a parser before datagrams are dropped
+const dataBufferSize = 1024
+
+// maximum size of a single newline or length-prefixed frame
+const maxFrameSize = 16 * 1024 * 1024
+
+// framing modes for stream connections
+const (
+	// one json batch per connection, read until EOF
+	FramingNone = "none"
+	// many json batches per connection, separated by newlines
+	FramingNewline = "newline"
+	// many json batches per connection, each prefixed by its
+	// length as a 4 byte big-endian unsigned integer
+	FramingLength = "length"
+)
+
 var (
 	logCloser io.WriteCloser
 	logger    *log.Logger
@@ -24,24 +50,107 @@ var (
 		},
 		[]string{"status"},
 	)
+
+	datagramsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pmp_datagrams_dropped_total",
+			Help: "Total count of datagrams dropped because the aggregator could not keep up",
+		},
+	)
 )
 
 type MetricSpec struct {
-	Type       string             `json:"type"`
-	Name       string             `json:"name"`
-	Help       string             `json:"help"`
-	Labels     []string           `json:"labels"`
-	Buckets    []float64          `json:"buckets"`
-	Objectives map[string]float64 `json:"objectives"`
+	Type             string             `json:"type"`
+	Name             string             `json:"name"`
+	Namespace        string             `json:"namespace"`
+	Subsystem        string             `json:"subsystem"`
+	Help             string             `json:"help"`
+	Labels           []string           `json:"labels"`
+	Buckets          []float64          `json:"buckets"`
+	Objectives       map[string]float64 `json:"objectives"`
+	MultiprocessMode string             `json:"multiprocess_mode"`
+	DeadPids         string             `json:"dead_pids"`
+	PeerLabels       []string           `json:"peer_labels"`
+	TTL              string             `json:"ttl"`
+	MaxSeries        int                `json:"max_series"`
+	Overflow         string             `json:"overflow"`
+	LabelDefaults    map[string]string  `json:"label_defaults"`
+	ConstLabels      map[string]string  `json:"const_labels"`
+
+	// where the spec was defined
+	file string
+	line int
+}
+
+// Source returns the file and line where the spec was defined
+func (spec *MetricSpec) Source() string {
+	file := spec.file
+	if file == "" {
+		file = "<input>"
+	}
+	return fmt.Sprintf("%s:%d", file, spec.line)
+}
+
+// labelNames returns the labels of the spec followed by its peer labels
+func (spec *MetricSpec) labelNames() []string {
+	if len(spec.PeerLabels) == 0 {
+		return spec.Labels
+	}
+	return append(append([]string{}, spec.Labels...), spec.PeerLabels...)
 }
 
 type Metric struct {
-	Name        string   `json:"name"`
-	LabelValues []string `json:"label_values"`
-	Method      string   `json:"method"`
-	Value       float64  `json:"value"`
+	Name        string            `json:"name"`
+	LabelValues []string          `json:"label_values"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Method      string            `json:"method"`
+	Value       float64           `json:"value"`
+	Pid         int               `json:"pid"`
+
+	// peer which sent the metric, if known
+	peer *Peer
+
+	// whether the metric may delete series or reset metrics, see Batch
+	admin bool
 }
 
+// Batch is a json batch of metrics as received from a peer, which
+// is nil when the sender is unknown
+type Batch struct {
+	Data []byte
+	Peer *Peer
+
+	// whether metrics may delete series or reset metrics, which is only
+	// allowed on the stream socket
+	Admin bool
+}
+
+// apply attributes m to the peer of the batch, and allows it to delete
+// series or reset metrics if the batch does
+func (b Batch) apply(m *Metric) {
+	b.Peer.apply(m)
+	m.admin = b.Admin
+}
+
+// BatchResult is the outcome of processing a single batch of metrics
+type BatchResult struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Errors   []*BatchError `json:"errors,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// BatchError describes why a metric in a batch was rejected
+type BatchError struct {
+	Index  int    `json:"index"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// FrameHandler is called with each json batch read from a connection,
+// a non-nil result is written back to the connection
+type FrameHandler func(batch Batch) *BatchResult
+
 type nopCloser struct {
 	io.Writer
 }
@@ -73,21 +182,73 @@ func SetLogger(file string) error {
 	return nil
 }
 
-func LoadSpecs(file string) ([]*MetricSpec, error) {
+// extensions of metric definition files in a directory
+var specExtensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+// LoadSpecs reads the metric definitions at path, which may be a single
+// file, a directory or a glob pattern, see SpecFiles. Files are read in
+// the given format, or according to their extension if it is empty.
+// Definitions from several files are merged, and a metric may only be
+// defined once.
+func LoadSpecs(path, format string) ([]*MetricSpec, error) {
+	specs, errs := readSpecFiles(path, format)
+	if len(errs) > 0 {
+		return specs, errs[0]
+	}
+
+	return specs, nil
+}
+
+// readSpecFiles reads the metric definitions at path like LoadSpecs,
+// but carries on after errors and returns all of them
+func readSpecFiles(path, format string) ([]*MetricSpec, []error) {
 	var (
 		specs []*MetricSpec
-		err   error
+		errs  []error
 	)
 
+	files, err := SpecFiles(path)
+	if err != nil {
+		return specs, append(errs, err)
+	}
+	if len(files) == 0 {
+		return specs, append(errs, fmt.Errorf("No metric definition files found at %s", path))
+	}
+
+	seen := make(map[string]*MetricSpec)
+	for _, file := range files {
+		fileSpecs, err := loadSpecsFile(file, specFormat(file, format))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", file, err))
+			continue
+		}
+
+		for _, spec := range fileSpecs {
+			spec.file = file
+			if other, ok := seen[spec.Name]; ok {
+				errs = append(errs, fmt.Errorf("%s: duplicate metric %s, first defined at %s", spec.Source(), spec.Name, other.Source()))
+				continue
+			}
+			seen[spec.Name] = spec
+			specs = append(specs, spec)
+		}
+	}
+
+	return specs, errs
+}
+
+func loadSpecsFile(file, format string) ([]*MetricSpec, error) {
 	specsFile, err := os.OpenFile(file, os.O_RDONLY, 0644)
 	if err != nil {
-		return specs, err
+		return nil, err
 	}
 	defer specsFile.Close()
 
-	return ReadSpecs(specsFile)
+	return ReadSpecsFormat(specsFile, format)
 }
 
+// ReadSpecs reads a json array of metric definitions from r, noting the
+// line on which each one starts
 func ReadSpecs(r io.Reader) ([]*MetricSpec, error) {
 	var result []*MetricSpec
 
@@ -96,44 +257,261 @@ func ReadSpecs(r io.Reader) ([]*MetricSpec, error) {
 		return result, err
 	}
 
-	err = json.Unmarshal(jsonBlob, &result)
+	dec := json.NewDecoder(bytes.NewReader(jsonBlob))
+	tok, err := dec.Token()
 	if err != nil {
 		return result, err
 	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return result, errors.New("metric definitions must be a json array")
+	}
+
+	for dec.More() {
+		line := lineAt(jsonBlob, dec.InputOffset())
+		spec := &MetricSpec{line: line}
+		if err := dec.Decode(spec); err != nil {
+			return result, fmt.Errorf("line %d: %s", line, err)
+		}
+		result = append(result, spec)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// lineAt returns the line of the first value at or after offset in data,
+// skipping whitespace and separators
+func lineAt(data []byte, offset int64) int {
+	for offset < int64(len(data)) && bytes.IndexByte([]byte(" \t\r\n,"), data[offset]) >= 0 {
+		offset++
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// SpecFiles returns the metric definition files at path, which may be a
+// single file, a directory whose files with a known extension are used,
+// or a glob pattern
+func SpecFiles(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		files, err := filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") || !sliceContainsStr(specExtensions, filepath.Ext(name)) {
+			continue
+		}
+		result = append(result, filepath.Join(path, name))
+	}
+	sort.Strings(result)
 
 	return result, nil
 }
 
-func DataReader(ln net.Listener, dataCh chan<- []byte) {
-	logger.Println("Starting listening on socket")
+func ValidateFraming(framing string) error {
+	switch framing {
+	case FramingNone, FramingNewline, FramingLength:
+		return nil
+	}
+	return fmt.Errorf("Unknown framing %s", framing)
+}
+
+func DataReader(ln net.Listener, framing string, handle FrameHandler) {
+	logger.Printf("Starting listening on socket (framing: %s)", framing)
 	for {
 		// accept a connection
 		c, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
 			CountMetric("error")
 			logger.Printf("ERROR (DataReader): %s", err)
 			continue
 		}
 
-		var buf bytes.Buffer
-		io.Copy(&buf, c)
-		dataCh <- buf.Bytes()
-		c.Close()
+		go func(c net.Conn) {
+			defer c.Close()
+
+			// the sender is unknown when credentials are unavailable, its
+			// name is only looked up by specs with a process_name label
+			peer, _ := PeerCred(c)
+
+			err = ReadFrames(c, framing, func(data []byte) {
+				result := handle(Batch{data, peer, true})
+				if result == nil {
+					return
+				}
+				if err := WriteFrame(c, framing, result); err != nil {
+					logger.Printf("ERROR (DataReader): %s", err)
+				}
+			})
+			if err != nil {
+				CountMetric("error")
+				logger.Printf("ERROR (DataReader): %s", err)
+			}
+		}(c)
 	}
 	logger.Println("Ending listening on socket")
 }
 
-func DataParser(dataCh <-chan []byte, metricCh chan<- Metric) {
+// QueueFrames returns a FrameHandler which sends batches to dataCh
+// to be processed asynchronously, without responding
+func QueueFrames(dataCh chan<- Batch) FrameHandler {
+	return func(batch Batch) *BatchResult {
+		dataCh <- batch
+		return nil
+	}
+}
+
+// AckFrames returns a FrameHandler which processes batches synchronously
+// and responds with the result of each one
+func AckFrames(registry Registry) FrameHandler {
+	return func(batch Batch) *BatchResult {
+		return ProcessBatch(registry, batch)
+	}
+}
+
+// ReadFrames reads json batches from r according to framing and calls fn
+// with each one as it arrives, until r is exhausted
+func ReadFrames(r io.Reader, framing string, fn func([]byte)) error {
+	switch framing {
+	default:
+		return fmt.Errorf("Unknown framing %s", framing)
+	case FramingNone:
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, r); err != nil {
+			return err
+		}
+		fn(buf.Bytes())
+	case FramingNewline:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 4096), maxFrameSize)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			// the scanner re-uses its buffer, so copy the line out
+			data := make([]byte, len(line))
+			copy(data, line)
+			fn(data)
+		}
+		return scanner.Err()
+	case FramingLength:
+		br := bufio.NewReader(r)
+		for {
+			var size uint32
+			err := binary.Read(br, binary.BigEndian, &size)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if size > maxFrameSize {
+				return fmt.Errorf("Frame size %d exceeds maximum of %d", size, maxFrameSize)
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return err
+			}
+			fn(data)
+		}
+	}
+	return nil
+}
+
+// WriteFrame writes v as json to w according to framing
+func WriteFrame(w io.Writer, framing string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	switch framing {
+	default:
+		return fmt.Errorf("Unknown framing %s", framing)
+	case FramingNone:
+	case FramingNewline:
+		data = append(data, '\n')
+	case FramingLength:
+		if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// DatagramReader reads datagrams from conn, each of which must contain
+// a single json batch of metrics, and sends them to dataCh
+func DatagramReader(conn net.PacketConn, dataCh chan<- Batch) {
+	logger.Printf("Starting listening on %s", conn.LocalAddr())
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			CountMetric("error")
+			logger.Printf("ERROR (DatagramReader): %s", err)
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		// never block, the sender cannot be told to slow down anyway
+		select {
+		case dataCh <- Batch{Data: data}:
+		default:
+			datagramsDropped.Inc()
+		}
+	}
+	logger.Printf("Ending listening on %s", conn.LocalAddr())
+}
+
+func DataParser(dataCh <-chan Batch, metricCh chan<- Metric) {
 	for {
 		var metrics []Metric
-		data := <-dataCh
-		err := json.Unmarshal(data, &metrics)
+		batch := <-dataCh
+		err := json.Unmarshal(batch.Data, &metrics)
 		if err != nil {
 			CountMetric("error")
 			logger.Printf("ERROR (DataParser): %s", err)
 			continue
 		}
 		for i := 0; i < len(metrics); i++ {
+			batch.apply(&metrics[i])
 			metricCh <- metrics[i]
 		}
 	}
@@ -156,3 +534,36 @@ func DataProcessor(registry Registry, metricCh <-chan Metric, doneCh <-chan bool
 		}
 	}
 }
+
+// ProcessBatch parses a json batch of metrics and handles each of them
+// synchronously, returning the outcome
+func ProcessBatch(registry Registry, batch Batch) *BatchResult {
+	result := &BatchResult{}
+
+	var metrics []Metric
+	if err := json.Unmarshal(batch.Data, &metrics); err != nil {
+		CountMetric("error")
+		logger.Printf("ERROR (ProcessBatch): %s", err)
+		result.Error = err.Error()
+		return result
+	}
+
+	for i := 0; i < len(metrics); i++ {
+		batch.apply(&metrics[i])
+		if err := registry.Handle(&metrics[i]); err != nil {
+			CountMetric("error")
+			logger.Printf("ERROR (ProcessBatch): %s %+v", err, metrics[i])
+			result.Rejected++
+			result.Errors = append(result.Errors, &BatchError{
+				Index:  i,
+				Name:   metrics[i].Name,
+				Reason: err.Error(),
+			})
+			continue
+		}
+		CountMetric("ok")
+		result.Accepted++
+	}
+
+	return result
+}
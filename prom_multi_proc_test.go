@@ -2,11 +2,20 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
 )
 
 func getTestSpecs(t *testing.T, i int) []*MetricSpec {
@@ -112,6 +121,22 @@ func SetTestLogger() {
 	logger = log.New(&out, "", log.LstdFlags)
 }
 
+// startReader runs read in the background, and returns a function which
+// closes c and waits for read to return. Readers log when they stop, which
+// must happen before the test ends and the next one replaces the logger.
+func startReader(c io.Closer, read func()) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		read()
+		close(done)
+	}()
+
+	return func() {
+		c.Close()
+		<-done
+	}
+}
+
 func TestMetrics1(t *testing.T) {
 	SetTestLogger()
 	specs := getTestSpecs(t, 1)
@@ -278,7 +303,7 @@ func TestMetrics3Rereg(t *testing.T) {
 	}
 
 	if !sliceContainsStr(unreg, mySpec.Name) {
-		t.Fatal("%s should be getting unregistered", mySpec.Name)
+		t.Fatalf("%s should be getting unregistered", mySpec.Name)
 	}
 
 	for _, name := range unreg {
@@ -299,7 +324,7 @@ func TestMetrics5Multi(t *testing.T) {
 	specs := getTestSpecs(t, 5)
 
 	metricCh := make(chan Metric)
-	dataCh := make(chan []byte)
+	dataCh := make(chan Batch)
 
 	registry := NewRegistry()
 
@@ -335,7 +360,7 @@ func TestMetrics5Multi(t *testing.T) {
 	}
 
 	go func() {
-		dataCh <- b
+		dataCh <- Batch{Data: b}
 	}()
 
 	for i := 0; i < 2; i++ {
@@ -372,3 +397,309 @@ func TestMetrics5Multi(t *testing.T) {
 		}
 	}
 }
+
+func TestDatagramReader(t *testing.T) {
+	SetTestLogger()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataCh := make(chan Batch, 1)
+	defer startReader(conn, func() { DatagramReader(conn, dataCh) })()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, batch := range []string{
+		`[{"name":"test_6_counter","method":"inc"}]`,
+		`[{"name":"test_6_gauge","method":"set","value":2}]`,
+	} {
+		if _, err := client.Write([]byte(batch)); err != nil {
+			t.Fatal(err)
+		}
+		data := (<-dataCh).Data
+		if string(data) != batch {
+			t.Fatalf("Expected datagram %s, but got %s", batch, data)
+		}
+	}
+}
+
+func TestDatagramReaderDrop(t *testing.T) {
+	SetTestLogger()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &dto.Metric{}
+	datagramsDropped.Write(m)
+	before := m.GetCounter().GetValue()
+
+	// nobody reads from the channel, so the second datagram is dropped
+	// instead of blocking the reader
+	dataCh := make(chan Batch, 1)
+	defer startReader(conn, func() { DatagramReader(conn, dataCh) })()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Write([]byte(`[]`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		datagramsDropped.Write(m)
+		if m.GetCounter().GetValue() == before+1 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected 1 dropped datagram, but got %g", m.GetCounter().GetValue()-before)
+}
+
+func lengthPrefixed(batches ...string) string {
+	var buf bytes.Buffer
+	for _, batch := range batches {
+		binary.Write(&buf, binary.BigEndian, uint32(len(batch)))
+		buf.WriteString(batch)
+	}
+	return buf.String()
+}
+
+func TestReadFrames(t *testing.T) {
+	a := `[{"name":"a","method":"inc"}]`
+	b := `[{"name":"b","method":"inc"}]`
+
+	for _, tt := range []struct {
+		framing string
+		input   string
+		r       []string
+		err     bool
+	}{
+		{FramingNone, a, []string{a}, false},
+		{FramingNone, a + "\n" + b, []string{a + "\n" + b}, false},
+		{FramingNewline, a, []string{a}, false},
+		{FramingNewline, a + "\n" + b + "\n", []string{a, b}, false},
+		{FramingNewline, a + "\r\n\n" + b, []string{a, b}, false},
+		{FramingNewline, "", []string{}, false},
+		{FramingLength, lengthPrefixed(a), []string{a}, false},
+		{FramingLength, lengthPrefixed(a, b), []string{a, b}, false},
+		{FramingLength, "", []string{}, false},
+		{FramingLength, lengthPrefixed(a)[:10], []string{}, true},
+		{"bogus", a, []string{}, true},
+	} {
+		r := []string{}
+		err := ReadFrames(strings.NewReader(tt.input), tt.framing, func(data []byte) {
+			r = append(r, string(data))
+		})
+		if (err != nil) != tt.err {
+			t.Errorf("ReadFrames(%q, %s) error => %v, want error %t", tt.input, tt.framing, err, tt.err)
+		}
+		if !sliceEqStr(r, tt.r) {
+			t.Errorf("ReadFrames(%q, %s) => %v, want %v", tt.input, tt.framing, r, tt.r)
+		}
+	}
+}
+
+func TestDataReaderPersistent(t *testing.T) {
+	SetTestLogger()
+
+	dir, err := ioutil.TempDir("", "prom_multi_proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ln, err := net.Listen("unix", filepath.Join(dir, "test.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataCh := make(chan Batch)
+	defer startReader(ln, func() { DataReader(ln, FramingNewline, QueueFrames(dataCh)) })()
+
+	client, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// a single connection carries several batches
+	for i := 0; i < 3; i++ {
+		batch := fmt.Sprintf(`[{"name":"test_7_counter_%d","method":"inc"}]`, i)
+		if _, err := fmt.Fprintln(client, batch); err != nil {
+			t.Fatal(err)
+		}
+		data := (<-dataCh).Data
+		if string(data) != batch {
+			t.Fatalf("Expected batch %s, but got %s", batch, data)
+		}
+	}
+}
+
+func TestDataReaderAck(t *testing.T) {
+	SetTestLogger()
+	specs := getTestSpecs(t, 10)
+
+	registry := NewRegistry()
+	for _, spec := range specs {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "prom_multi_proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, framing := range []string{FramingNone, FramingNewline, FramingLength} {
+		ln, err := net.Listen("unix", filepath.Join(dir, framing+".sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer startReader(ln, func() { DataReader(ln, framing, AckFrames(registry)) })()
+
+		client, err := net.Dial("unix", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		batch := `[{"name":"test_10_counter","method":"inc"},{"name":"test_10_missing","method":"inc"},{"name":"test_10_counter","method":"add","value":-1}]`
+		switch framing {
+		case FramingNone:
+			client.Write([]byte(batch))
+			client.(*net.UnixConn).CloseWrite()
+		case FramingNewline:
+			fmt.Fprintln(client, batch)
+		case FramingLength:
+			client.Write([]byte(lengthPrefixed(batch)))
+		}
+
+		var results []string
+		err = ReadFrames(client, framing, func(data []byte) {
+			results = append(results, string(data))
+			// stop reading after the first response
+			client.SetReadDeadline(time.Now())
+		})
+		if len(results) != 1 {
+			t.Fatalf("Expected 1 result with %s framing, but got %d (%v)", framing, len(results), err)
+		}
+
+		var r BatchResult
+		if err := json.Unmarshal([]byte(results[0]), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Accepted != 1 || r.Rejected != 2 || len(r.Errors) != 2 {
+			t.Fatalf("Expected 1 accepted and 2 rejected with %s framing, but got %+v", framing, r)
+		}
+		if r.Errors[0].Index != 1 || r.Errors[0].Name != "test_10_missing" || !strings.Contains(r.Errors[0].Reason, "does not exist") {
+			t.Fatalf("Unexpected first error with %s framing: %+v", framing, r.Errors[0])
+		}
+		if r.Errors[1].Index != 2 || !strings.Contains(r.Errors[1].Reason, "cannot decrease") {
+			t.Fatalf("Unexpected second error with %s framing: %+v", framing, r.Errors[1])
+		}
+	}
+}
+
+func TestLoadSpecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prom_multi_proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	a := write("a.json", `[
+	{"type": "counter", "name": "test_16_a", "help": "A"},
+
+	{
+		"type": "counter",
+		"name": "test_16_b",
+		"help": "B"
+	}
+]`)
+	b := write("b.json", `[{"type": "gauge", "name": "test_16_c", "help": "C"}]`)
+	write("c.txt", `not json`)
+
+	for _, tt := range []struct {
+		path    string
+		names   []string
+		sources []string
+	}{
+		{a, []string{"test_16_a", "test_16_b"}, []string{a + ":2", a + ":4"}},
+		{dir, []string{"test_16_a", "test_16_b", "test_16_c"}, []string{a + ":2", a + ":4", b + ":1"}},
+		{filepath.Join(dir, "b.*"), []string{"test_16_c"}, []string{b + ":1"}},
+	} {
+		specs, err := LoadSpecs(tt.path, "")
+		if err != nil {
+			t.Fatalf("LoadSpecs(%s) => unexpected error %s", tt.path, err)
+		}
+		var names, sources []string
+		for _, spec := range specs {
+			names = append(names, spec.Name)
+			sources = append(sources, spec.Source())
+		}
+		if !sliceEqStr(names, tt.names) {
+			t.Errorf("LoadSpecs(%s) names => %v, want %v", tt.path, names, tt.names)
+		}
+		if !sliceEqStr(sources, tt.sources) {
+			t.Errorf("LoadSpecs(%s) sources => %v, want %v", tt.path, sources, tt.sources)
+		}
+	}
+
+	// a metric may only be defined once across all files
+	d := write("d.json", `[
+	{"type": "gauge", "name": "test_16_d", "help": "D"},
+	{"type": "gauge", "name": "test_16_b", "help": "B"}
+]`)
+	_, err = LoadSpecs(dir, "")
+	if err == nil {
+		t.Fatal("Expected duplicate metric to throw error, but did not")
+	}
+	if want := d + ":3: duplicate metric test_16_b, first defined at " + a + ":4"; err.Error() != want {
+		t.Fatalf("Expected error %q, but got %q", want, err)
+	}
+
+	for _, path := range []string{
+		filepath.Join(dir, "missing.json"),
+		filepath.Join(dir, "missing.*"),
+		write("e.json", `{"type": "gauge"}`),
+	} {
+		if _, err := LoadSpecs(path, ""); err == nil {
+			t.Errorf("LoadSpecs(%s) => expected error, but got none", path)
+		}
+	}
+
+	// files without definitions, like placeholders, define nothing
+	for _, path := range []string{
+		write("f.json", `[]`),
+		write("g.yaml", "# no metrics\n"),
+		write("h.toml", "# no metrics\n"),
+	} {
+		if specs, err := LoadSpecs(path, ""); err != nil || len(specs) != 0 {
+			t.Errorf("LoadSpecs(%s) => %d specs %v, want none", path, len(specs), err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// policies for series with a pid label whose process has exited
+var deadPidsPolicies = []string{
+	// leave the series exported, the default
+	"keep",
+	// delete the series
+	"drop",
+}
+
+// pidReaper is implemented by handlers which keep state per process
+type pidReaper interface {
+	Reap() int
+}
+
+func validateDeadPids(spec *MetricSpec) error {
+	if spec.DeadPids == "" {
+		return nil
+	}
+
+	if !sliceContainsStr(deadPidsPolicies, spec.DeadPids) {
+		return fmt.Errorf("Metric %s has unknown dead_pids policy %s", spec.Name, spec.DeadPids)
+	}
+
+	if spec.DeadPids == "drop" && !sliceContainsStr(spec.labelNames(), pidLabel) {
+		return fmt.Errorf("Metric %s has dead_pids policy drop, but no %s label", spec.Name, pidLabel)
+	}
+
+	return nil
+}
+
+// PidReaper periodically removes state belonging to processes which no
+// longer exist from registry
+func PidReaper(registry Registry, interval time.Duration) {
+	for range time.Tick(interval) {
+		if n := registry.Reap(); n > 0 {
+			logger.Printf("Removed %d series of dead processes", n)
+		}
+	}
+}
+
+// reapVec deletes the series of h whose pid label refers to a process
+// which no longer exists, if its spec asks for it
+func reapVec(h VecHandler) int {
+	spec := h.Spec()
+	if spec.DeadPids != "drop" {
+		return 0
+	}
+
+	idx := -1
+	for i, label := range spec.labelNames() {
+		if label == pidLabel {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return 0
+	}
+
+	var n int
+	for _, labelValues := range collectSeries(h) {
+		pid, err := strconv.Atoi(labelValues[idx])
+		if err != nil || pidAlive(pid) {
+			continue
+		}
+		if deleteSeries(h, labelValues) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// pid under which the values of dead processes are folded together
+const foldedPid = -1
+
+// Reap removes the values of processes which no longer exist. Live
+// modes drop them, sum, max and min fold them into a single value so
+// the aggregate is unchanged, and all keeps them.
+func (h *MultiprocGaugeHandler) Reap() int {
+	mode := h.spec.MultiprocessMode
+	if mode == "all" {
+		return 0
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var n int
+	for key, series := range h.series {
+		for pid, value := range series.pids {
+			if pidAlive(pid) {
+				continue
+			}
+
+			if folded, ok := series.pids[foldedPid]; !ok {
+				if !isLiveMode(mode) {
+					series.pids[foldedPid] = value
+				}
+			} else {
+				switch mode {
+				case "sum":
+					series.pids[foldedPid] = folded + value
+				case "max":
+					series.pids[foldedPid] = math.Max(folded, value)
+				case "min":
+					series.pids[foldedPid] = math.Min(folded, value)
+				}
+			}
+
+			delete(series.pids, pid)
+			n++
+		}
+
+		if len(series.pids) == 0 {
+			delete(h.series, key)
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestReapMultiprocGauge(t *testing.T) {
+	SetTestLogger()
+
+	alive := os.Getpid()
+	dead := deadPid(t)
+
+	for i, tt := range []struct {
+		mode string
+		n    int
+		r    float64
+	}{
+		{"sum", 1, 8},
+		{"livesum", 1, 3},
+		{"max", 1, 5},
+		{"min", 1, 3},
+		{"all", 0, 0},
+	} {
+		spec := &MetricSpec{
+			Type:             "gauge",
+			Name:             fmt.Sprintf("test_12_gauge_%d", i),
+			Help:             "Test 12 gauge",
+			MultiprocessMode: tt.mode,
+		}
+
+		registry := NewRegistry()
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, m := range []Metric{
+			{Name: spec.Name, Method: "set", Value: 3, Pid: alive},
+			{Name: spec.Name, Method: "set", Value: 5, Pid: dead},
+		} {
+			if err := registry.Handle(&m); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if n := registry.Reap(); n != tt.n {
+			t.Errorf("Mode %s reaped %d, want %d", tt.mode, n, tt.n)
+		}
+		// reaping again finds nothing left to remove
+		if n := registry.Reap(); n != 0 {
+			t.Errorf("Mode %s reaped %d again, want 0", tt.mode, n)
+		}
+
+		handler := registry.(*ireg).Handlers[spec.Name]
+		r := collectValues(t, handler.Collector())
+		if tt.mode != "all" && r[""] != tt.r {
+			t.Errorf("Mode %s after reap => %v, want %f", tt.mode, r, tt.r)
+		}
+
+		if err := registry.Unregister(spec.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReapVec(t *testing.T) {
+	SetTestLogger()
+
+	alive := strconv.Itoa(os.Getpid())
+	dead := strconv.Itoa(deadPid(t))
+
+	for i, tt := range []struct {
+		typ      string
+		deadPids string
+		n        int
+	}{
+		{"counter", "drop", 1},
+		{"gauge", "drop", 1},
+		{"histogram", "drop", 1},
+		{"summary", "drop", 1},
+		{"counter", "keep", 0},
+		{"counter", "", 0},
+	} {
+		spec := &MetricSpec{
+			Type:     tt.typ,
+			Name:     fmt.Sprintf("test_12_%s_vec_%d", tt.typ, i),
+			Help:     "Test 12 vector",
+			Labels:   []string{"pid", "one"},
+			DeadPids: tt.deadPids,
+		}
+
+		registry := NewRegistry()
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, labelValues := range [][]string{{alive, "a"}, {dead, "a"}, {"", "a"}} {
+			m := Metric{Name: spec.Name, Method: "inc", Value: 1, LabelValues: labelValues}
+			switch tt.typ {
+			case "gauge":
+				m.Method = "set"
+			case "histogram", "summary":
+				m.Method = "observe"
+			}
+			if err := registry.Handle(&m); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if n := registry.Reap(); n != tt.n {
+			t.Errorf("Reap of %s with dead_pids %q => %d, want %d", tt.typ, tt.deadPids, n, tt.n)
+		}
+
+		handler := registry.(*ireg).Handlers[spec.Name].(VecHandler)
+		if series := collectSeries(handler); len(series) != 3-tt.n {
+			t.Errorf("Series of %s with dead_pids %q after reap => %v", tt.typ, tt.deadPids, series)
+		}
+
+		if err := registry.Unregister(spec.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestValidateDeadPids(t *testing.T) {
+	for _, tt := range []struct {
+		spec MetricSpec
+		err  bool
+	}{
+		{MetricSpec{}, false},
+		{MetricSpec{DeadPids: "keep"}, false},
+		{MetricSpec{DeadPids: "drop", Labels: []string{"one", "pid"}}, false},
+		{MetricSpec{DeadPids: "drop", Labels: []string{"one"}}, true},
+		{MetricSpec{DeadPids: "bogus", Labels: []string{"pid"}}, true},
+	} {
+		err := validateDeadPids(&tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("validateDeadPids(%+v) => %v, want error %t", tt.spec, err, tt.err)
+		}
+	}
+}
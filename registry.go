@@ -4,13 +4,23 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var (
-	metricRe = regexp.MustCompile(`^[a-z]+\[[0-9a-z_]+\]$`)
+	metricRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelRe  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// labels which are added to the series of a metric type by prometheus
+	reservedLabels = map[string]string{
+		"histogram": "le",
+		"summary":   "quantile",
+	}
 
 	defaultBuckets = []float64{
 		0.005,
@@ -35,17 +45,48 @@ var (
 type ireg struct {
 	Handlers map[string]MetricHandler
 	mu       sync.Mutex
+
+	// prometheus registry of the collectors of all handlers, which is
+	// rebuilt when a handler is replaced
+	preg *prometheus.Registry
+
+	// automatic registration of unknown metrics
+	templates []*MetricTemplate
+	auto      map[string]bool
+	autoMax   int
 }
 
 type Registry interface {
+	prometheus.Gatherer
 	Names() []string
+	AutoNames() []string
+	SetTemplates([]*MetricTemplate, int)
+	Spec(string) *MetricSpec
+	Series(string) ([]*Series, error)
 	Register(*MetricSpec) error
+	Replace(*MetricSpec, bool) (bool, error)
 	Unregister(string) error
+	Delete(*Metric) error
+	Reset(string) error
 	Handle(*Metric) error
+	Reap() int
+	Expire(time.Time) int
 }
 
 func NewRegistry() Registry {
-	return &ireg{Handlers: make(map[string]MetricHandler)}
+	return &ireg{
+		Handlers: make(map[string]MetricHandler),
+		preg:     prometheus.NewRegistry(),
+		auto:     make(map[string]bool),
+	}
+}
+
+func (r *ireg) Gather() ([]*dto.MetricFamily, error) {
+	r.mu.Lock()
+	preg := r.preg
+	r.mu.Unlock()
+
+	return preg.Gather()
 }
 
 func (r *ireg) Names() []string {
@@ -61,29 +102,52 @@ func (r *ireg) Names() []string {
 	return result
 }
 
+func (r *ireg) Spec(name string) *MetricSpec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	handler, ok := r.Handlers[name]
+	if !ok {
+		return nil
+	}
+
+	return handler.Spec()
+}
+
 func (r *ireg) Register(spec *MetricSpec) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	_, err := r.register(spec)
+	return err
+}
+
+// register builds and registers a handler for spec, the caller must
+// hold the lock
+func (r *ireg) register(spec *MetricSpec) (MetricHandler, error) {
 	if _, ok := r.Handlers[spec.Name]; ok {
-		return fmt.Errorf("Metric %s already exists", spec.Name)
+		return nil, fmt.Errorf("Metric %s already exists", spec.Name)
 	}
 
 	if err := validateMetric(spec.Name); err != nil {
-		return err
+		return nil, err
 	}
 
 	handler, err := buildHandler(spec)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := prometheus.Register(handler.Collector()); err != nil {
-		return err
+	if err := validateExported(spec); err != nil {
+		return nil, err
+	}
+
+	if err := r.preg.Register(handler.Collector()); err != nil {
+		return nil, err
 	}
 
 	r.Handlers[spec.Name] = handler
-	return nil
+	return handler, nil
 }
 
 func (r *ireg) Unregister(name string) error {
@@ -95,11 +159,12 @@ func (r *ireg) Unregister(name string) error {
 		return fmt.Errorf("Unregister: metric %s does not exist", name)
 	}
 
-	if ok := prometheus.Unregister(handler.Collector()); !ok {
+	if ok := r.preg.Unregister(handler.Collector()); !ok {
 		return fmt.Errorf("Failed to unregister %s", name)
 	}
 
 	delete(r.Handlers, name)
+	delete(r.auto, name)
 
 	return nil
 }
@@ -108,74 +173,181 @@ func (r *ireg) Handle(metric *Metric) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	// label values are resolved on a copy, leaving those of the caller alone
+	m := *metric
+	metric = &m
+
+	// label values of admin methods are given in full, including those
+	// of peer labels
+	if isAdminMethod(metric.Method) {
+		if !metric.admin {
+			return fmt.Errorf("Metric %s has method %s, which is only accepted on the stream socket", metric.Name, metric.Method)
+		}
+		return r.handleAdmin(metric)
+	}
+
 	handler, ok := r.Handlers[metric.Name]
 	if !ok {
-		return fmt.Errorf("Handle: metric %s does not exist", metric.Name)
+		var err error
+		handler, err = r.autoRegister(metric.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	spec := handler.Spec()
+	if metric.Labels != nil {
+		labelValues, err := resolveLabels(spec, spec.Labels, metric)
+		if err != nil {
+			return err
+		}
+		metric.LabelValues, metric.Labels = labelValues, nil
+	} else if len(metric.LabelValues) < len(spec.Labels) {
+		labelValues, err := padLabelValues(spec, metric)
+		if err != nil {
+			return err
+		}
+		metric.LabelValues = labelValues
+	}
+
+	if len(spec.PeerLabels) > 0 {
+		metric.LabelValues = appendPeerLabelValues(spec, metric)
 	}
 
 	return handler.Handle(metric)
 }
 
+// Reap removes state belonging to processes which no longer exist and
+// returns the number of series or process values removed
+func (r *ireg) Reap() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int
+	for _, handler := range r.Handlers {
+		switch h := handler.(type) {
+		case pidReaper:
+			n += h.Reap()
+		case VecHandler:
+			n += reapVec(h)
+		}
+	}
+
+	return n
+}
+
 func buildHandler(spec *MetricSpec) (MetricHandler, error) {
 	var handler MetricHandler
 
+	labels := spec.labelNames()
+
+	if err := validateMultiprocessMode(spec); err != nil {
+		return nil, err
+	}
+
+	if err := validateDeadPids(spec); err != nil {
+		return nil, err
+	}
+
+	if err := validatePeerLabels(spec); err != nil {
+		return nil, err
+	}
+
+	if err := validateTTL(spec); err != nil {
+		return nil, err
+	}
+
+	if err := validateMaxSeries(spec); err != nil {
+		return nil, err
+	}
+
+	if err := validateLabelDefaults(spec); err != nil {
+		return nil, err
+	}
+
+	if err := validateConstLabels(spec); err != nil {
+		return nil, err
+	}
+
+	if err := validateNamespace(spec); err != nil {
+		return nil, err
+	}
+
 	switch spec.Type {
 	default:
 		return nil, fmt.Errorf("Unknown metric %s is unknown type %s", spec.Name, spec.Type)
 	case "counter":
 		opts := prometheus.CounterOpts{
-			Name: spec.Name,
-			Help: spec.Help,
+			Namespace:   spec.namespace(),
+			Subsystem:   spec.Subsystem,
+			Name:        spec.Name,
+			Help:        spec.Help,
+			ConstLabels: spec.constLabels(),
 		}
-		if len(spec.Labels) == 0 {
+		if len(labels) == 0 {
 			counter := prometheus.NewCounter(opts)
 			handler = &CounterHandler{spec, counter}
 		} else {
-			if err := validateLabels(spec.Labels); err != nil {
+			if err := validateLabels(spec.Type, labels); err != nil {
 				return nil, err
 			}
 
-			counterVec := prometheus.NewCounterVec(opts, spec.Labels)
-			handler = &CounterVecHandler{spec, counterVec}
+			counterVec := prometheus.NewCounterVec(opts, labels)
+			handler = &CounterVecHandler{spec, counterVec, newSeriesTracker(spec)}
 		}
 	case "gauge":
 		opts := prometheus.GaugeOpts{
-			Name: spec.Name,
-			Help: spec.Help,
+			Namespace:   spec.namespace(),
+			Subsystem:   spec.Subsystem,
+			Name:        spec.Name,
+			Help:        spec.Help,
+			ConstLabels: spec.constLabels(),
 		}
-		if len(spec.Labels) == 0 {
+		if isMultiprocessMode(spec.MultiprocessMode) {
+			if err := validateLabels(spec.Type, labels); err != nil {
+				return nil, err
+			}
+
+			handler = NewMultiprocGaugeHandler(spec)
+		} else if len(labels) == 0 {
 			gauge := prometheus.NewGauge(opts)
 			handler = &GaugeHandler{spec, gauge}
 		} else {
-			if err := validateLabels(spec.Labels); err != nil {
+			if err := validateLabels(spec.Type, labels); err != nil {
 				return nil, err
 			}
 
-			gaugeVec := prometheus.NewGaugeVec(opts, spec.Labels)
-			handler = &GaugeVecHandler{spec, gaugeVec}
+			gaugeVec := prometheus.NewGaugeVec(opts, labels)
+			handler = &GaugeVecHandler{spec, gaugeVec, newSeriesTracker(spec)}
 		}
 	case "histogram":
 		var buckets []float64
 		if len(spec.Buckets) > 0 {
+			if err := validateBuckets(spec.Buckets); err != nil {
+				return nil, err
+			}
 			buckets = spec.Buckets
 		} else {
 			buckets = defaultBuckets
 		}
 		opts := prometheus.HistogramOpts{
-			Name:    spec.Name,
-			Help:    spec.Help,
-			Buckets: buckets,
+			Namespace:   spec.namespace(),
+			Subsystem:   spec.Subsystem,
+			Name:        spec.Name,
+			Help:        spec.Help,
+			ConstLabels: spec.constLabels(),
+			Buckets:     buckets,
 		}
-		if len(spec.Labels) == 0 {
+		if len(labels) == 0 {
 			histogram := prometheus.NewHistogram(opts)
 			handler = &HistogramHandler{spec, histogram}
 		} else {
-			if err := validateLabels(spec.Labels); err != nil {
+			if err := validateLabels(spec.Type, labels); err != nil {
 				return nil, err
 			}
 
-			histogramVec := prometheus.NewHistogramVec(opts, spec.Labels)
-			handler = &HistogramVecHandler{spec, histogramVec}
+			histogramVec := prometheus.NewHistogramVec(opts, labels)
+			handler = &HistogramVecHandler{spec, histogramVec, newSeriesTracker(spec)}
 		}
 	case "summary":
 		var (
@@ -191,20 +363,23 @@ func buildHandler(spec *MetricSpec) (MetricHandler, error) {
 			objectives = defaultObjectives
 		}
 		opts := prometheus.SummaryOpts{
-			Name:       spec.Name,
-			Help:       spec.Help,
-			Objectives: objectives,
+			Namespace:   spec.namespace(),
+			Subsystem:   spec.Subsystem,
+			Name:        spec.Name,
+			Help:        spec.Help,
+			ConstLabels: spec.constLabels(),
+			Objectives:  objectives,
 		}
-		if len(spec.Labels) == 0 {
+		if len(labels) == 0 {
 			summary := prometheus.NewSummary(opts)
 			handler = &SummaryHandler{spec, summary}
 		} else {
-			if err := validateLabels(spec.Labels); err != nil {
+			if err := validateLabels(spec.Type, labels); err != nil {
 				return nil, err
 			}
 
-			summaryVec := prometheus.NewSummaryVec(opts, spec.Labels)
-			handler = &SummaryVecHandler{spec, summaryVec}
+			summaryVec := prometheus.NewSummaryVec(opts, labels)
+			handler = &SummaryVecHandler{spec, summaryVec, newSeriesTracker(spec)}
 		}
 	}
 
@@ -213,17 +388,56 @@ func buildHandler(spec *MetricSpec) (MetricHandler, error) {
 
 func validateMetric(name string) error {
 	if !metricRe.MatchString(name) {
-		fmt.Errorf("Metric name '%s' is not valid", name)
+		return fmt.Errorf("Metric name '%s' is not valid, it must match %s", name, metricRe)
 	}
 
 	return nil
 }
 
-func validateLabels(labels []string) error {
+// validateExported checks that the exported name of spec does not clash
+// with the metrics of this process, which are gathered from the default
+// registry along with those of the spec, nor with the prefix reserved for
+// them
+func validateExported(spec *MetricSpec) error {
+	name := spec.fqName()
+	if strings.HasPrefix(name, "pmp_") {
+		return fmt.Errorf("Metric %s is not valid, names starting with pmp_ are reserved", name)
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return fmt.Errorf("Metric %s is not valid, it is exported by prom_multi_proc itself", name)
+		}
+	}
+
+	return nil
+}
+
+func validateLabel(typ, label string) error {
+	if !labelRe.MatchString(label) {
+		return fmt.Errorf("Label name '%s' is not valid, it must match %s", label, labelRe)
+	}
+
+	if strings.HasPrefix(label, "__") {
+		return fmt.Errorf("Label name '%s' is not valid, names starting with __ are reserved", label)
+	}
+
+	if reserved, ok := reservedLabels[typ]; ok && label == reserved {
+		return fmt.Errorf("Label name '%s' is not valid, it is reserved for %ss", label, typ)
+	}
+
+	return nil
+}
+
+func validateLabels(typ string, labels []string) error {
 	n := len(labels)
 
-	for i := 0; i < n-1; i++ {
-		err := validateMetric(labels[i])
+	for i := 0; i < n; i++ {
+		err := validateLabel(typ, labels[i])
 		if err != nil {
 			return err
 		}
@@ -246,8 +460,24 @@ func validateObjectives(objectives map[string]float64) (map[float64]float64, err
 		if err != nil {
 			return result, err
 		}
+		if f < 0 || f > 1 {
+			return result, fmt.Errorf("Objective quantile %s is not between 0 and 1", key)
+		}
+		if value < 0 || value > 1 {
+			return result, fmt.Errorf("Objective error %g of quantile %s is not between 0 and 1", value, key)
+		}
 		result[f] = value
 	}
 
 	return result, nil
 }
+
+func validateBuckets(buckets []float64) error {
+	for i, bucket := range buckets {
+		if i > 0 && bucket <= buckets[i-1] {
+			return fmt.Errorf("Buckets are not in increasing order: %g follows %g", bucket, buckets[i-1])
+		}
+	}
+
+	return nil
+}
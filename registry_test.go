@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// hasSeries reports whether the named metric of registry, which must have
+// labels, has a series with labelValues in the order of its spec
+func hasSeries(registry Registry, name string, labelValues []string) bool {
+	h := registry.(*ireg).Handlers[name].(VecHandler)
+	for _, values := range collectSeries(h) {
+		if sliceEqStr(values, labelValues) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateMetric(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		ok   bool
+	}{
+		{"test_metric", true},
+		{"Test_Metric_2", true},
+		{"_test", true},
+		{"test:metric", true},
+		{":test", true},
+		{"", false},
+		{"2test", false},
+		{"test-metric", false},
+		{"test metric", false},
+		{"test.metric", false},
+		{"test[metric]", false},
+	} {
+		if err := validateMetric(tt.name); (err == nil) != tt.ok {
+			t.Errorf("validateMetric(%q) => %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	for _, tt := range []struct {
+		typ    string
+		labels []string
+		ok     bool
+	}{
+		{"counter", []string{}, true},
+		{"counter", []string{"one"}, true},
+		{"counter", []string{"one", "Two", "_three", "four_4"}, true},
+		{"counter", []string{"one", "two", "one"}, false},
+		{"counter", []string{"one", "one"}, false},
+		{"counter", []string{"one", "two-2"}, false},
+		{"counter", []string{"one", "2two"}, false},
+		{"counter", []string{"one", ""}, false},
+		{"counter", []string{"one", "tw:o"}, false},
+		{"counter", []string{"one", "__two"}, false},
+		{"counter", []string{"le", "quantile"}, true},
+		{"histogram", []string{"one", "le"}, false},
+		{"summary", []string{"one", "quantile"}, false},
+		{"summary", []string{"one", "le"}, true},
+	} {
+		if err := validateLabels(tt.typ, tt.labels); (err == nil) != tt.ok {
+			t.Errorf("validateLabels(%s, %v) => %v, want ok %t", tt.typ, tt.labels, err, tt.ok)
+		}
+	}
+}
+
+func TestRegisterInvalidNames(t *testing.T) {
+	registry := NewRegistry()
+
+	for _, spec := range []*MetricSpec{
+		{Type: "counter", Name: "test-19-a", Help: "A"},
+		{Type: "counter", Name: "test_19_b", Help: "B", Labels: []string{"one", "two-2"}},
+		{Type: "gauge", Name: "test_19_c", Help: "C", Labels: []string{"__one"}},
+		{Type: "histogram", Name: "test_19_d", Help: "D", Labels: []string{"le"}},
+		{Type: "summary", Name: "test_19_e", Help: "E", Labels: []string{"quantile"}},
+	} {
+		if err := registry.Register(spec); err == nil {
+			t.Errorf("Register(%s %v) => nil, want error", spec.Name, spec.Labels)
+		}
+	}
+
+	if names := registry.Names(); len(names) != 0 {
+		t.Errorf("Names() => %v, want none", names)
+	}
+}
+
+func TestRegisterExportedNames(t *testing.T) {
+	registry := NewRegistry()
+
+	for _, spec := range []*MetricSpec{
+		{Type: "gauge", Name: "go_goroutines", Help: "Goroutines"},
+		{Type: "counter", Name: "pmp_test_38_a", Help: "A"},
+		{Type: "counter", Namespace: "pmp", Name: "test_38_b", Help: "B"},
+	} {
+		if err := registry.Register(spec); err == nil {
+			t.Errorf("Register(%s) => nil, want error", spec.fqName())
+		}
+		if errs := ValidateSpec(spec); len(errs) == 0 {
+			t.Errorf("ValidateSpec(%s) => no errors, want some", spec.fqName())
+		}
+	}
+
+	spec := &MetricSpec{Type: "gauge", Name: "test_38_c", Help: "C"}
+	if err := registry.Register(spec); err != nil {
+		t.Fatal(err)
+	}
+	replaced := &MetricSpec{Type: "gauge", Namespace: "pmp", Name: spec.Name, Help: "C"}
+	if _, err := registry.Replace(replaced, true); err == nil {
+		t.Errorf("Replace(pmp_%s) => nil, want error", spec.Name)
+	}
+
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+	if _, err := gatherers.Gather(); err != nil {
+		t.Errorf("Gather() => %s", err)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// what to do with the state of a metric whose spec changes on reload
+var reloadStates = []string{
+	// keep the values of metrics whose labels are unchanged, and whose
+	// buckets or objectives are unchanged for histograms and summaries
+	"carry",
+	// start from scratch
+	"reset",
+}
+
+// specEqual reports whether a and b define the same metric
+func specEqual(a, b *MetricSpec) bool {
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
+
+// ReloadResult describes the changes a reload made to a registry, or
+// would have made in a dry run
+type ReloadResult struct {
+	// all definitions were loaded and applied without conflicts
+	OK        bool              `json:"ok"`
+	DryRun    bool              `json:"dry_run"`
+	Added     []string          `json:"added"`
+	Removed   []string          `json:"removed"`
+	Changed   []string          `json:"changed"`
+	Unchanged []string          `json:"unchanged"`
+	Conflicts []*ReloadConflict `json:"conflicts"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// ReloadConflict is a metric definition which could not be applied, the
+// registered metric of the same name, if any, is left as it was
+type ReloadConflict struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+}
+
+func (result *ReloadResult) conflict(spec *MetricSpec, err error) {
+	result.Conflicts = append(result.Conflicts, &ReloadConflict{
+		Name:   spec.Name,
+		Source: spec.Source(),
+		Reason: err.Error(),
+	})
+}
+
+// Log writes a summary of result and a line for each change to the logger
+func (result *ReloadResult) Log() {
+	prefix := ""
+	if result.DryRun {
+		prefix = "Dry run: "
+	}
+
+	if result.Error != "" {
+		logger.Printf("%sError loading configuration: %s", prefix, result.Error)
+		return
+	}
+
+	logger.Printf("%s%d added, %d removed, %d changed, %d unchanged, %d conflicting",
+		prefix, len(result.Added), len(result.Removed), len(result.Changed),
+		len(result.Unchanged), len(result.Conflicts))
+	for _, name := range result.Added {
+		logger.Printf("%sAdded %s", prefix, name)
+	}
+	for _, name := range result.Removed {
+		logger.Printf("%sRemoved %s", prefix, name)
+	}
+	for _, name := range result.Changed {
+		logger.Printf("%sChanged %s", prefix, name)
+	}
+	for _, c := range result.Conflicts {
+		logger.Printf("%sConflicting %s at %s: %s", prefix, c.Name, c.Source, c.Reason)
+	}
+}
+
+// Reload brings registry in line with specs: new metrics are registered,
+// changed ones are replaced and ones no longer defined are unregistered,
+// except for automatically registered metrics. Specs which are not valid
+// are reported as conflicts. If dryRun is true, the registry is left
+// untouched and the result reports what would have been done.
+func Reload(registry Registry, specs []*MetricSpec, carry, dryRun bool) *ReloadResult {
+	result := &ReloadResult{
+		DryRun:    dryRun,
+		Added:     []string{},
+		Removed:   []string{},
+		Changed:   []string{},
+		Unchanged: []string{},
+		Conflicts: []*ReloadConflict{},
+	}
+
+	// note beginning names of metrics
+	names := registry.Names()
+	newNames := []string{}
+
+	for _, spec := range specs {
+		newNames = append(newNames, spec.Name)
+
+		old := registry.Spec(spec.Name)
+		if old != nil && specEqual(old, spec) {
+			result.Unchanged = append(result.Unchanged, spec.Name)
+			continue
+		}
+
+		if errs := ValidateSpec(spec); len(errs) > 0 {
+			result.conflict(spec, errs[0])
+			continue
+		}
+
+		if old == nil {
+			if !dryRun {
+				if err := registry.Register(spec); err != nil {
+					result.conflict(spec, err)
+					continue
+				}
+			}
+			result.Added = append(result.Added, spec.Name)
+			continue
+		}
+
+		// rebuild existing metrics whose definition has changed
+		if !dryRun {
+			carried, err := registry.Replace(spec, carry)
+			if err != nil {
+				result.conflict(spec, err)
+				continue
+			} else if carried {
+				logger.Printf("Replaced %s, state carried over", spec.Name)
+			} else {
+				logger.Printf("Replaced %s, state reset", spec.Name)
+			}
+		}
+		result.Changed = append(result.Changed, spec.Name)
+	}
+
+	// get names of metrics no longer present and unregister them,
+	// automatically registered metrics are kept while they still
+	// match a template
+	for _, name := range sliceSubStr(names, append(newNames, registry.AutoNames()...)) {
+		if !dryRun {
+			if err := registry.Unregister(name); err != nil {
+				logger.Println(err)
+				continue
+			}
+		}
+		result.Removed = append(result.Removed, name)
+	}
+	sort.Strings(result.Removed)
+
+	result.OK = len(result.Conflicts) == 0
+	return result
+}
+
+// Replace rebuilds the handler of an existing metric from spec. If carry
+// is true, the state of the old handler is carried over to the new one
+// when they are compatible, and the result reports whether it was.
+func (r *ireg) Replace(spec *MetricSpec, carry bool) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	carried, err := r.replace(spec, carry)
+	if err != nil {
+		return false, err
+	}
+
+	delete(r.auto, spec.Name)
+
+	return carried, nil
+}
+
+// replace builds a handler for spec in place of the existing one of the
+// same name, and returns both, the caller must hold the lock
+func (r *ireg) replace(spec *MetricSpec, carry bool) (bool, error) {
+	old, ok := r.Handlers[spec.Name]
+	if !ok {
+		return false, fmt.Errorf("Replace: metric %s does not exist", spec.Name)
+	}
+
+	if err := validateMetric(spec.Name); err != nil {
+		return false, err
+	}
+
+	handler, err := buildHandler(spec)
+	if err != nil {
+		return false, err
+	}
+
+	if err := validateExported(spec); err != nil {
+		return false, err
+	}
+
+	// state is carried before the handler is registered, as histograms
+	// and summaries carry theirs by taking over the old collector
+	carried := carry && carryState(old, handler)
+
+	// the prometheus registry never forgets the labels and help of a
+	// metric name, so a new one is built with the new handler in place
+	// of the old one
+	preg := prometheus.NewRegistry()
+	for name, h := range r.Handlers {
+		if name == spec.Name {
+			h = handler
+		}
+		if err := preg.Register(h.Collector()); err != nil {
+			return false, err
+		}
+	}
+
+	r.preg = preg
+	r.Handlers[spec.Name] = handler
+
+	return carried, nil
+}
+
+// carryState copies the values of old to h if both are counters or
+// gauges with the same labels, and reports whether it did. The observations
+// of histograms and summaries cannot be copied, so h keeps the collector of
+// old instead if it exports the same metric with the same buckets or
+// objectives.
+func carryState(old, h MetricHandler) bool {
+	oldSpec, spec := old.Spec(), h.Spec()
+	if oldSpec.Type != spec.Type || !sliceEqStr(oldSpec.labelNames(), spec.labelNames()) {
+		return false
+	}
+
+	if o, ok := old.(*MultiprocGaugeHandler); ok {
+		if n, ok := h.(*MultiprocGaugeHandler); ok {
+			n.series = o.copySeries()
+			return true
+		}
+		return false
+	}
+
+	metrics := collectMetrics(old.Collector(), oldSpec.labelNames())
+
+	switch n := h.(type) {
+	default:
+		return false
+	case *CounterHandler:
+		for _, cm := range metrics {
+			n.Counter.Add(cm.Metric.GetCounter().GetValue())
+		}
+	case *CounterVecHandler:
+		for _, cm := range metrics {
+			n.CounterVec.WithLabelValues(cm.LabelValues...).Add(cm.Metric.GetCounter().GetValue())
+			n.tracker.touch(cm.LabelValues)
+		}
+	case *GaugeHandler:
+		for _, cm := range metrics {
+			n.Gauge.Set(cm.Metric.GetGauge().GetValue())
+		}
+	case *GaugeVecHandler:
+		for _, cm := range metrics {
+			n.GaugeVec.WithLabelValues(cm.LabelValues...).Set(cm.Metric.GetGauge().GetValue())
+			n.tracker.touch(cm.LabelValues)
+		}
+	case *HistogramHandler, *SummaryHandler:
+		if !sameObservations(old, h) {
+			return false
+		}
+		switch o := old.(type) {
+		case *HistogramHandler:
+			n.(*HistogramHandler).Histogram = o.Histogram
+		case *SummaryHandler:
+			n.(*SummaryHandler).Summary = o.Summary
+		}
+	case *HistogramVecHandler:
+		if !sameObservations(old, h) {
+			return false
+		}
+		n.HistogramVec = old.(*HistogramVecHandler).HistogramVec
+		for _, cm := range metrics {
+			n.tracker.touch(cm.LabelValues)
+		}
+	case *SummaryVecHandler:
+		if !sameObservations(old, h) {
+			return false
+		}
+		n.SummaryVec = old.(*SummaryVecHandler).SummaryVec
+		for _, cm := range metrics {
+			n.tracker.touch(cm.LabelValues)
+		}
+	}
+
+	return true
+}
+
+// sameObservations reports whether the histograms or summaries of old and h
+// are described alike and have the same buckets or objectives, so that h
+// can take over the collector of old
+func sameObservations(old, h MetricHandler) bool {
+	oldSpec, spec := old.Spec(), h.Spec()
+	if !floatsEqual(oldSpec.Buckets, spec.Buckets) || len(oldSpec.Objectives) != len(spec.Objectives) {
+		return false
+	}
+	for q, e := range spec.Objectives {
+		if oe, ok := oldSpec.Objectives[q]; !ok || oe != e {
+			return false
+		}
+	}
+
+	return describe(old.Collector()) == describe(h.Collector())
+}
+
+func floatsEqual(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// describe returns the descriptions of the metrics of c as a string
+func describe(c prometheus.Collector) string {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(ch)
+		close(ch)
+	}()
+
+	var descs []string
+	for desc := range ch {
+		descs = append(descs, desc.String())
+	}
+	return strings.Join(descs, "\n")
+}
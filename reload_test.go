@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// gatherValue returns the value of the counter or gauge series of the
+// named metric family in registry with the given label values
+func gatherValue(t *testing.T, registry Registry, name string, labelValues ...string) (float64, bool) {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			var values []string
+			for _, pair := range m.GetLabel() {
+				values = append(values, pair.GetValue())
+			}
+			if !sliceEqStr(values, labelValues) {
+				continue
+			}
+			switch {
+			case m.Counter != nil:
+				return m.GetCounter().GetValue(), true
+			case m.Histogram != nil:
+				return m.GetHistogram().GetSampleSum(), true
+			case m.Summary != nil:
+				return m.GetSummary().GetSampleSum(), true
+			}
+			return m.GetGauge().GetValue(), true
+		}
+	}
+
+	return 0, false
+}
+
+func TestReplace(t *testing.T) {
+	SetTestLogger()
+
+	for _, tt := range []struct {
+		old     MetricSpec
+		new     MetricSpec
+		carry   bool
+		carried bool
+		labels  []string
+	}{
+		{
+			MetricSpec{Type: "counter", Help: "Old"},
+			MetricSpec{Type: "counter", Help: "New"},
+			true, true, nil,
+		},
+		{
+			MetricSpec{Type: "counter", Help: "Old"},
+			MetricSpec{Type: "counter", Help: "New"},
+			false, false, nil,
+		},
+		{
+			MetricSpec{Type: "counter", Help: "Old", Labels: []string{"one"}},
+			MetricSpec{Type: "counter", Help: "New", Labels: []string{"one"}},
+			true, true, []string{"a"},
+		},
+		{
+			MetricSpec{Type: "counter", Help: "Old", Labels: []string{"one"}},
+			MetricSpec{Type: "counter", Help: "Old", Labels: []string{"one", "two"}},
+			true, false, []string{"a", ""},
+		},
+		{
+			MetricSpec{Type: "gauge", Help: "Old", Labels: []string{"one"}},
+			MetricSpec{Type: "gauge", Help: "New", Labels: []string{"one"}},
+			true, true, []string{"a"},
+		},
+		{
+			MetricSpec{Type: "gauge", Help: "Old"},
+			MetricSpec{Type: "gauge", Help: "Old", MultiprocessMode: "sum"},
+			true, false, nil,
+		},
+		{
+			MetricSpec{Type: "gauge", Help: "Old", MultiprocessMode: "max"},
+			MetricSpec{Type: "gauge", Help: "Old", MultiprocessMode: "sum"},
+			true, true, nil,
+		},
+		{
+			MetricSpec{Type: "histogram", Help: "Old", Buckets: []float64{1, 2}},
+			MetricSpec{Type: "histogram", Help: "Old", Buckets: []float64{1, 2, 3}},
+			true, false, nil,
+		},
+		{
+			MetricSpec{Type: "histogram", Help: "Old", Buckets: []float64{1, 2}},
+			MetricSpec{Type: "histogram", Help: "Old", Buckets: []float64{1, 2}, Overflow: "reject"},
+			true, true, nil,
+		},
+		{
+			MetricSpec{Type: "histogram", Help: "Old", Labels: []string{"one"}},
+			MetricSpec{Type: "histogram", Help: "Old", Labels: []string{"one"}, TTL: "1m"},
+			true, true, []string{"a"},
+		},
+		{
+			MetricSpec{Type: "histogram", Help: "Old", Labels: []string{"one"}},
+			MetricSpec{Type: "histogram", Help: "New", Labels: []string{"one"}},
+			true, false, nil,
+		},
+		{
+			MetricSpec{Type: "summary", Help: "Old", Objectives: map[string]float64{"0.5": 0.05}},
+			MetricSpec{Type: "summary", Help: "Old", Objectives: map[string]float64{"0.5": 0.05}, Overflow: "reject"},
+			true, true, nil,
+		},
+		{
+			MetricSpec{Type: "summary", Help: "Old", Labels: []string{"one"}},
+			MetricSpec{Type: "summary", Help: "Old", Labels: []string{"one"}, MaxSeries: 10},
+			true, true, []string{"a"},
+		},
+		{
+			MetricSpec{Type: "summary", Help: "Old", Objectives: map[string]float64{"0.5": 0.05}},
+			MetricSpec{Type: "summary", Help: "Old", Objectives: map[string]float64{"0.9": 0.01}},
+			true, false, nil,
+		},
+		{
+			MetricSpec{Type: "counter", Help: "Old"},
+			MetricSpec{Type: "gauge", Help: "Old"},
+			true, false, nil,
+		},
+	} {
+		registry := NewRegistry()
+
+		tt.old.Name = "test_15_metric"
+		tt.new.Name = "test_15_metric"
+		if err := registry.Register(&tt.old); err != nil {
+			t.Fatal(err)
+		}
+		// an unrelated metric which must survive the replacement
+		other := &MetricSpec{Type: "counter", Name: "test_15_other", Help: "Other"}
+		if err := registry.Register(other); err != nil {
+			t.Fatal(err)
+		}
+
+		var labelValues []string
+		if len(tt.old.Labels) > 0 {
+			labelValues = []string{"a"}
+		}
+		for _, m := range []Metric{
+			{Name: tt.old.Name, Method: "inc", LabelValues: labelValues, Value: 3},
+			{Name: tt.old.Name, Method: "add", LabelValues: labelValues, Value: 3},
+			{Name: tt.old.Name, Method: "observe", LabelValues: labelValues, Value: 3},
+			{Name: other.Name, Method: "inc"},
+		} {
+			registry.Handle(&m)
+		}
+
+		if specEqual(&tt.old, &tt.new) {
+			t.Fatalf("Expected %+v and %+v to differ", tt.old, tt.new)
+		}
+
+		carried, err := registry.Replace(&tt.new, tt.carry)
+		if err != nil {
+			t.Fatalf("Replace(%+v) => unexpected error %s", tt.new, err)
+		}
+		if carried != tt.carried {
+			t.Errorf("Replace(%+v) carried => %t, want %t", tt.new, carried, tt.carried)
+		}
+		if spec := registry.Spec(tt.new.Name); !specEqual(spec, &tt.new) {
+			t.Errorf("Replace(%+v) => spec %+v", tt.new, spec)
+		}
+
+		if tt.carried {
+			value, ok := gatherValue(t, registry, tt.new.Name, tt.labels...)
+			if !ok || value == 0 {
+				t.Errorf("Replace(%+v) => expected value to be carried over", tt.new)
+			}
+		}
+		if value, _ := gatherValue(t, registry, other.Name); value != 1 {
+			t.Errorf("Replace(%+v) => other metric value %f, want 1", tt.new, value)
+		}
+	}
+}
+
+// TestReplaceConcurrent is meant to be run with -race, replacing metrics
+// while they are updated and gathered
+func TestReplaceConcurrent(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	specs := []*MetricSpec{
+		{Type: "gauge", Name: "test_15_concurrent_gauge", Help: "Gauge", Labels: []string{"one"}, MultiprocessMode: "sum"},
+		{Type: "histogram", Name: "test_15_concurrent_histogram", Help: "Histogram", Labels: []string{"one"}},
+	}
+	for _, spec := range specs {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gather := func(i int) {
+		registry.Gather()
+	}
+
+	var wg sync.WaitGroup
+	for _, work := range []func(i int){
+		func(i int) {
+			registry.Handle(&Metric{Name: specs[0].Name, Method: "set", Value: 1, LabelValues: []string{fmt.Sprint(i % 10)}, Pid: i % 3})
+			registry.Handle(&Metric{Name: specs[1].Name, Method: "observe", Value: 1, LabelValues: []string{fmt.Sprint(i % 10)}})
+		},
+		// gathering from more than one goroutine keeps old registries
+		// collecting while the replaced metrics are updated
+		gather, gather,
+		func(i int) {
+			for _, spec := range specs {
+				replaced := *spec
+				replaced.TTL = fmt.Sprintf("%dm", i+1)
+				if _, err := registry.Replace(&replaced, true); err != nil {
+					t.Error(err)
+				}
+			}
+		},
+	} {
+		wg.Add(1)
+		go func(work func(i int)) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				work(i)
+			}
+		}(work)
+	}
+	wg.Wait()
+
+	if value, found := gatherValue(t, registry, specs[1].Name, "0"); !found || value == 0 {
+		t.Errorf("%s[0] => %g %t, want observations carried over", specs[1].Name, value, found)
+	}
+}
+
+func TestReplaceMissing(t *testing.T) {
+	registry := NewRegistry()
+	spec := &MetricSpec{Type: "counter", Name: "test_15_missing", Help: "Missing"}
+	if _, err := registry.Replace(spec, true); err == nil {
+		t.Fatal("Expected replacing missing metric to throw error, but did not")
+	}
+}
+
+func TestReload(t *testing.T) {
+	SetTestLogger()
+
+	registry := NewRegistry()
+	for _, spec := range []*MetricSpec{
+		{Type: "counter", Name: "test_20_same", Help: "Same"},
+		{Type: "counter", Name: "test_20_changed", Help: "Old"},
+		{Type: "counter", Name: "test_20_removed", Help: "Removed"},
+		{Type: "counter", Name: "test_20_conflict", Help: "Conflict"},
+	} {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	specs := []*MetricSpec{
+		{Type: "counter", Name: "test_20_same", Help: "Same"},
+		{Type: "counter", Name: "test_20_changed", Help: "New"},
+		{Type: "counter", Name: "test_20_conflict", Help: "Conflict", Labels: []string{"le-1"}},
+		{Type: "gauge", Name: "test_20_added", Help: "Added"},
+		{Type: "gauge", Name: "test_20_invalid", Help: "Invalid", MultiprocessMode: "first"},
+	}
+
+	check := func(result *ReloadResult) {
+		for _, tt := range []struct {
+			field string
+			got   []string
+			want  []string
+		}{
+			{"Added", result.Added, []string{"test_20_added"}},
+			{"Removed", result.Removed, []string{"test_20_removed"}},
+			{"Changed", result.Changed, []string{"test_20_changed"}},
+			{"Unchanged", result.Unchanged, []string{"test_20_same"}},
+		} {
+			if !sliceEqStr(tt.got, tt.want) {
+				t.Errorf("Reload %s => %v, want %v", tt.field, tt.got, tt.want)
+			}
+		}
+
+		var conflicts []string
+		for _, c := range result.Conflicts {
+			conflicts = append(conflicts, c.Name)
+		}
+		if want := []string{"test_20_conflict", "test_20_invalid"}; !sliceEqStr(conflicts, want) {
+			t.Errorf("Reload Conflicts => %v, want %v", conflicts, want)
+		}
+	}
+
+	// a dry run reports the changes without making them
+	result := Reload(registry, specs, true, true)
+	check(result)
+	if !result.DryRun {
+		t.Errorf("Reload DryRun => false, want true")
+	}
+	if spec := registry.Spec("test_20_changed"); spec.Help != "Old" {
+		t.Errorf("Dry run changed help to %s", spec.Help)
+	}
+	for name, want := range map[string]bool{"test_20_added": false, "test_20_removed": true} {
+		if got := registry.Spec(name) != nil; got != want {
+			t.Errorf("Dry run: %s registered => %t, want %t", name, got, want)
+		}
+	}
+
+	result = Reload(registry, specs, true, false)
+	check(result)
+	if spec := registry.Spec("test_20_changed"); spec.Help != "New" {
+		t.Errorf("Reload help => %s, want New", spec.Help)
+	}
+	for name, want := range map[string]bool{
+		"test_20_added":    true,
+		"test_20_removed":  false,
+		"test_20_conflict": true,
+		"test_20_invalid":  false,
+	} {
+		if got := registry.Spec(name) != nil; got != want {
+			t.Errorf("Reload: %s registered => %t, want %t", name, got, want)
+		}
+	}
+	if spec := registry.Spec("test_20_conflict"); len(spec.Labels) != 0 {
+		t.Errorf("Reload replaced conflicting metric with labels %v", spec.Labels)
+	}
+
+	// reloading again changes nothing
+	result = Reload(registry, specs, true, false)
+	if len(result.Added)+len(result.Removed)+len(result.Changed) != 0 {
+		t.Errorf("Second reload => %+v, want no changes", result)
+	}
+}
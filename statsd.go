@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// characters which are valid in statsd names but not in prometheus names
+	statsdNameRe = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+)
+
+// StatsdReader reads statsd and dogstatsd datagrams from conn, translates
+// each line into a Metric and sends it to metricCh
+func StatsdReader(conn net.PacketConn, registry Registry, metricCh chan<- Metric) {
+	logger.Printf("Starting listening for statsd on %s", conn.LocalAddr())
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			CountMetric("error")
+			logger.Printf("ERROR (StatsdReader): %s", err)
+			continue
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			metric, err := ParseStatsd(line, registry)
+			if err != nil {
+				CountMetric("error")
+				logger.Printf("ERROR (StatsdReader): %s %q", err, line)
+				continue
+			}
+			metricCh <- metric
+		}
+	}
+	logger.Printf("Ending listening for statsd on %s", conn.LocalAddr())
+}
+
+// ParseStatsd translates a single statsd line of the form
+// name:value|type[|@rate][|#tag:value,...] into a Metric. Dogstatsd
+// tags are mapped onto the labels of the registered spec by name,
+// labels without a matching tag get an empty value and tags without
+// a matching label are ignored.
+func ParseStatsd(line string, registry Registry) (Metric, error) {
+	var metric Metric
+
+	idx := strings.Index(line, ":")
+	if idx < 1 {
+		return metric, errors.New("statsd line is missing name")
+	}
+	metric.Name = statsdNameRe.ReplaceAllString(line[:idx], "_")
+
+	parts := strings.Split(line[idx+1:], "|")
+	if len(parts) < 2 {
+		return metric, errors.New("statsd line is missing type")
+	}
+
+	valueStr := parts[0]
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return metric, fmt.Errorf("invalid statsd value %s", valueStr)
+	}
+
+	rate := 1.0
+	tags := make(map[string]string)
+	for _, part := range parts[2:] {
+		if strings.HasPrefix(part, "@") {
+			rate, err = strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return metric, fmt.Errorf("invalid statsd sample rate %s", part[1:])
+			}
+		} else if strings.HasPrefix(part, "#") {
+			for _, tag := range strings.Split(part[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 2 {
+					tags[kv[0]] = kv[1]
+				} else {
+					tags[kv[0]] = ""
+				}
+			}
+		}
+	}
+
+	switch parts[1] {
+	default:
+		return metric, fmt.Errorf("unsupported statsd type %s", parts[1])
+	case "c":
+		metric.Method = "add"
+		metric.Value = value / rate
+	case "g":
+		// a leading sign makes the gauge relative to its current value
+		if strings.HasPrefix(valueStr, "+") || strings.HasPrefix(valueStr, "-") {
+			metric.Method = "add"
+		} else {
+			metric.Method = "set"
+		}
+		metric.Value = value
+	case "ms":
+		// statsd timers are in milliseconds, prometheus uses seconds
+		metric.Method = "observe"
+		metric.Value = value / 1000
+	case "h", "d":
+		metric.Method = "observe"
+		metric.Value = value
+	}
+
+	if spec := registry.Spec(metric.Name); spec != nil && len(spec.Labels) > 0 {
+		metric.LabelValues = make([]string, len(spec.Labels))
+		for i, label := range spec.Labels {
+			value, ok := tags[label]
+			if !ok {
+				value = spec.LabelDefaults[label]
+			}
+			metric.LabelValues[i] = value
+		}
+	}
+
+	return metric, nil
+}
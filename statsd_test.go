@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStatsd(t *testing.T) {
+	SetTestLogger()
+	specs := getTestSpecs(t, 8)
+
+	registry := NewRegistry()
+	for _, spec := range specs {
+		if err := registry.Register(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		line string
+		r    Metric
+	}{
+		{"test_8_counter:1|c", Metric{Name: "test_8_counter", Method: "add", Value: 1}},
+		{"test_8_counter:2|c|@0.5", Metric{Name: "test_8_counter", Method: "add", Value: 4}},
+		{"test.8.counter:1|c", Metric{Name: "test_8_counter", Method: "add", Value: 1}},
+		{"test_8_gauge:5|g", Metric{Name: "test_8_gauge", Method: "set", Value: 5}},
+		{"test_8_gauge:+5|g", Metric{Name: "test_8_gauge", Method: "add", Value: 5}},
+		{"test_8_gauge:-5|g", Metric{Name: "test_8_gauge", Method: "add", Value: -5}},
+		{"test_8_histogram:250|ms", Metric{Name: "test_8_histogram", Method: "observe", Value: 0.25}},
+		{"test_8_histogram:0.3|h", Metric{Name: "test_8_histogram", Method: "observe", Value: 0.3}},
+		{"test_8_summary:0.3|d", Metric{Name: "test_8_summary", Method: "observe", Value: 0.3}},
+		{
+			"test_8_counter_vec:1|c|#three:c,one:a,extra:x",
+			Metric{Name: "test_8_counter_vec", Method: "add", Value: 1, LabelValues: []string{"a", "", "c"}},
+		},
+		{
+			"test_8_gauge_vec:1|g|@1|#one:a,two:b,three:c",
+			Metric{Name: "test_8_gauge_vec", Method: "set", Value: 1, LabelValues: []string{"a", "b", "c"}},
+		},
+	} {
+		r, err := ParseStatsd(tt.line, registry)
+		if err != nil {
+			t.Errorf("ParseStatsd(%q) => unexpected error %s", tt.line, err)
+			continue
+		}
+		if r.Name != tt.r.Name || r.Method != tt.r.Method || r.Value != tt.r.Value || !sliceEqStr(r.LabelValues, tt.r.LabelValues) {
+			t.Errorf("ParseStatsd(%q) => %+v, want %+v", tt.line, r, tt.r)
+		}
+		if err := registry.Handle(&r); err != nil {
+			t.Errorf("Handle(%+v) => unexpected error %s", r, err)
+		}
+	}
+
+	for _, line := range []string{
+		"test_8_counter",
+		":1|c",
+		"test_8_counter:1",
+		"test_8_counter:one|c",
+		"test_8_counter:1|s",
+		"test_8_counter:1|c|@2",
+	} {
+		if _, err := ParseStatsd(line, registry); err == nil {
+			t.Errorf("ParseStatsd(%q) => expected error, but got none", line)
+		}
+	}
+}
+
+func TestParseStatsdUnknown(t *testing.T) {
+	registry := NewRegistry()
+
+	r, err := ParseStatsd("test_8_unknown:1|c|#one:a", registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.LabelValues) != 0 {
+		t.Fatalf("Expected no label values for unknown metric, but got %v", r.LabelValues)
+	}
+	if err := registry.Handle(&r); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("Expected unknown metric to fail to be handled, but got %v", err)
+	}
+}
+
+func TestParseStatsdDefaults(t *testing.T) {
+	registry := NewRegistry()
+	spec := &MetricSpec{
+		Type:          "counter",
+		Name:          "test_33_counter",
+		Help:          "Counter",
+		Labels:        []string{"one", "two"},
+		LabelDefaults: map[string]string{"two": "b"},
+	}
+	if err := registry.Register(spec); err != nil {
+		t.Fatal(err)
+	}
+
+	for line, want := range map[string][]string{
+		"test_33_counter:1|c|#one:a":        {"a", "b"},
+		"test_33_counter:1|c|#one:a,two:c":  {"a", "c"},
+		"test_33_counter:1|c|#two:c":        {"", "c"},
+		"test_33_counter:1|c|#one:a,two:":   {"a", ""},
+		"test_33_counter:1|c|#three:c,two:": {"", ""},
+	} {
+		r, err := ParseStatsd(line, registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sliceEqStr(r.LabelValues, want) {
+			t.Errorf("ParseStatsd(%q) => %v, want %v", line, r.LabelValues, want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+type seriesTime struct {
+	labelValues []string
+	updated     time.Time
+}
+
+// seriesTracker keeps track of the series of a vec handler, when each was
+// last updated for ttl expiry and how many there are for max_series. A nil
+// seriesTracker, for specs with neither, tracks nothing.
+type seriesTracker struct {
+	name     string
+	labels   int
+	ttl      time.Duration
+	max      int
+	overflow string
+	series   map[string]*seriesTime
+	mu       sync.Mutex
+}
+
+func newSeriesTracker(spec *MetricSpec) *seriesTracker {
+	ttl, max := spec.ttl(), spec.maxSeries()
+	if ttl == 0 && max == 0 {
+		return nil
+	}
+
+	return &seriesTracker{
+		name:     spec.Name,
+		labels:   len(spec.labelNames()),
+		ttl:      ttl,
+		max:      max,
+		overflow: spec.overflow(),
+		series:   make(map[string]*seriesTime),
+	}
+}
+
+// touch records that the series with labelValues was updated now
+func (t *seriesTracker) touch(labelValues []string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	if st, ok := t.series[key]; ok {
+		st.updated = time.Now()
+		return
+	}
+	t.series[key] = &seriesTime{
+		labelValues: append([]string{}, labelValues...),
+		updated:     time.Now(),
+	}
+}
+
+// forget stops tracking the series with labelValues
+func (t *seriesTracker) forget(labelValues []string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.series, strings.Join(labelValues, "\xff"))
+}
+
+// reset stops tracking all series
+func (t *seriesTracker) reset() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.series = make(map[string]*seriesTime)
+}
+
+// expired forgets and returns the label values of each series which has
+// not been updated within the ttl before now
+func (t *seriesTracker) expired(now time.Time) [][]string {
+	if t == nil || t.ttl == 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var result [][]string
+	for key, st := range t.series {
+		if now.Sub(st.updated) < t.ttl {
+			continue
+		}
+		result = append(result, st.labelValues)
+		delete(t.series, key)
+	}
+
+	return result
+}
+
+// deleteSeries deletes the series with labelValues from h
+func deleteSeries(h VecHandler, labelValues []string) bool {
+	h.tracked().forget(labelValues)
+	return h.Vec().DeleteLabelValues(labelValues...)
+}
+
+// resetSeries deletes all series from h
+func resetSeries(h VecHandler) {
+	h.tracked().reset()
+	h.Vec().Reset()
+}
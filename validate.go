@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+var metricTypes = []string{"counter", "gauge", "histogram", "summary"}
+
+// ValidateSpec checks spec for every problem which would prevent it from
+// being registered, and returns all of them
+func ValidateSpec(spec *MetricSpec) (errs []error) {
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	check(validateMetric(spec.Name))
+	if !sliceContainsStr(metricTypes, spec.Type) {
+		check(fmt.Errorf("Metric %s has unknown type %s", spec.Name, spec.Type))
+	}
+	check(validateLabels(spec.Type, spec.labelNames()))
+	check(validateMultiprocessMode(spec))
+	check(validateDeadPids(spec))
+	check(validatePeerLabels(spec))
+	check(validateTTL(spec))
+	check(validateMaxSeries(spec))
+	check(validateLabelDefaults(spec))
+	check(validateConstLabels(spec))
+	check(validateNamespace(spec))
+	if len(errs) == 0 {
+		check(validateExported(spec))
+	}
+
+	switch spec.Type {
+	case "histogram":
+		check(validateBuckets(spec.Buckets))
+		check(validatePositiveBuckets(spec.Buckets))
+	case "summary":
+		_, err := validateObjectives(spec.Objectives)
+		check(err)
+	}
+
+	// building the handler catches anything not checked above, including
+	// panics from the prometheus client
+	if len(errs) == 0 {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					check(fmt.Errorf("Metric %s is invalid: %s", spec.Name, r))
+				}
+			}()
+			_, err := buildHandler(spec)
+			check(err)
+		}()
+	}
+
+	return errs
+}
+
+// ValidateSpecs reads the metric definitions at path like LoadSpecs and
+// validates each of them, writing every problem found to w. It returns
+// the number of problems.
+func ValidateSpecs(w io.Writer, path, format string) int {
+	specs, errs := readSpecFiles(path, format)
+	for _, err := range errs {
+		fmt.Fprintln(w, err)
+	}
+
+	n := len(errs)
+	for _, spec := range specs {
+		for _, err := range ValidateSpec(spec) {
+			fmt.Fprintf(w, "%s: %s\n", spec.Source(), err)
+			n++
+		}
+	}
+
+	if n == 0 {
+		fmt.Fprintf(w, "%s: %d metrics OK\n", path, len(specs))
+	}
+
+	return n
+}
+
+// validatePositiveBuckets checks that buckets are positive, which is not
+// required when metrics are loaded, but most likely a mistake in files
+// checked by validate
+func validatePositiveBuckets(buckets []float64) error {
+	for _, bucket := range buckets {
+		if bucket <= 0 {
+			return fmt.Errorf("Bucket %g is not positive", bucket)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateSpec(t *testing.T) {
+	for _, tt := range []struct {
+		spec MetricSpec
+		errs int
+	}{
+		{MetricSpec{Type: "counter", Name: "test_18_a", Help: "A"}, 0},
+		{MetricSpec{Type: "histogram", Name: "test_18_a", Help: "A", Buckets: []float64{0.1, 1, 10}}, 0},
+		{MetricSpec{Type: "summary", Name: "test_18_a", Help: "A", Objectives: map[string]float64{"0.5": 0.05}}, 0},
+		{MetricSpec{Type: "count", Name: "test_18_a", Help: "A"}, 1},
+		{MetricSpec{Type: "counter", Name: "test_18_a", Help: "A", Labels: []string{"one", "two", "one"}}, 1},
+		{MetricSpec{Type: "histogram", Name: "test_18_a", Help: "A", Buckets: []float64{1, 0.1}}, 1},
+		{MetricSpec{Type: "histogram", Name: "test_18_a", Help: "A", Buckets: []float64{-1, 0, 1}}, 1},
+		{MetricSpec{Type: "histogram", Name: "test_18_a", Help: "A", Buckets: []float64{1, 1}}, 1},
+		{MetricSpec{Type: "summary", Name: "test_18_a", Help: "A", Objectives: map[string]float64{"1.5": 0.05}}, 1},
+		{MetricSpec{Type: "summary", Name: "test_18_a", Help: "A", Objectives: map[string]float64{"0.5": -1}}, 1},
+		{MetricSpec{Type: "summary", Name: "test_18_a", Help: "A", Objectives: map[string]float64{"half": 0.05}}, 1},
+		{MetricSpec{Type: "counter", Name: "test_18_a", Help: "A", MultiprocessMode: "sum", DeadPids: "drop"}, 2},
+	} {
+		if errs := ValidateSpec(&tt.spec); len(errs) != tt.errs {
+			t.Errorf("ValidateSpec(%+v) => %v, want %d errors", tt.spec, errs, tt.errs)
+		}
+	}
+}
+
+func TestValidateSpecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prom_multi_proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	a := write("a.json", `[
+	{"type": "counter", "name": "test_18_a", "help": "A"},
+	{"type": "histogram", "name": "test_18_b", "help": "B", "buckets": [1, 0.5]},
+	{"type": "gauge", "name": "test_18_c", "help": "C", "labels": ["one", "one"]}
+]`)
+
+	var out bytes.Buffer
+	if n := ValidateSpecs(&out, a, ""); n != 2 {
+		t.Fatalf("ValidateSpecs(%s) => %d problems, want 2:\n%s", a, n, out.String())
+	}
+	for _, want := range []string{a + ":3: ", a + ":4: "} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected output to contain %q, but got:\n%s", want, out.String())
+		}
+	}
+
+	b := write("b.yaml", `
+- {type: counter, name: test_18_a, help: A}
+- {type: summary, name: test_18_d, help: D, objectives: {2: 0.1}}
+`)
+	write("c.toml", `not toml`)
+
+	out.Reset()
+	if n := ValidateSpecs(&out, dir, ""); n != 5 {
+		t.Fatalf("ValidateSpecs(%s) => %d problems, want 5:\n%s", dir, n, out.String())
+	}
+	if want := b + ":2: duplicate metric test_18_a"; !strings.Contains(out.String(), want) {
+		t.Errorf("Expected output to contain %q, but got:\n%s", want, out.String())
+	}
+
+	ok := write("ok.json", `[{"type": "counter", "name": "test_18_a", "help": "A"}]`)
+	out.Reset()
+	if n := ValidateSpecs(&out, ok, ""); n != 0 {
+		t.Fatalf("ValidateSpecs(%s) => %d problems, want 0:\n%s", ok, n, out.String())
+	}
+
+	// buckets which are not positive are loaded, but reported by validate
+	positive := write("positive.json", `[{"type": "histogram", "name": "test_18_e", "help": "E", "buckets": [0, 1]}]`)
+	out.Reset()
+	if n := ValidateSpecs(&out, positive, ""); n != 1 {
+		t.Fatalf("ValidateSpecs(%s) => %d problems, want 1:\n%s", positive, n, out.String())
+	}
+	if want := positive + ":1: Bucket 0 is not positive"; !strings.Contains(out.String(), want) {
+		t.Errorf("Expected output to contain %q, but got:\n%s", want, out.String())
+	}
+	specs, err := LoadSpecs(positive, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRegistry().Register(specs[0]); err != nil {
+		t.Errorf("Register(%s) => %s, want buckets accepted", specs[0].Name, err)
+	}
+}
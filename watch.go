@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileWatcher detects changes to the metric definition files at a path
+// by polling them. Since files are looked up by path on every poll,
+// replacing a file by renaming another one over it is detected as well.
+type fileWatcher struct {
+	path    string
+	last    snapshot
+	pending snapshot
+	waiting bool
+}
+
+// snapshot holds info about each of a set of files by path
+type snapshot map[string]os.FileInfo
+
+func newFileWatcher(path string) *fileWatcher {
+	return &fileWatcher{path: path, last: takeSnapshot(path)}
+}
+
+func takeSnapshot(path string) snapshot {
+	result := make(snapshot)
+
+	files, err := SpecFiles(path)
+	if err != nil {
+		return result
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			result[file] = info
+		}
+	}
+
+	return result
+}
+
+// fileChange describes how a file changed from old to new, or returns an
+// empty string if it did not
+func fileChange(old, new os.FileInfo) string {
+	switch {
+	case old == nil && new == nil:
+		return ""
+	case old == nil:
+		return "created"
+	case new == nil:
+		return "removed"
+	case !os.SameFile(old, new):
+		return "replaced"
+	case old.Size() != new.Size() || !old.ModTime().Equal(new.ModTime()):
+		return "modified"
+	}
+	return ""
+}
+
+// snapshotChanges describes how each file changed from old to new
+func snapshotChanges(old, new snapshot) []string {
+	var result []string
+
+	files := make(map[string]bool)
+	for file := range old {
+		files[file] = true
+	}
+	for file := range new {
+		files[file] = true
+	}
+
+	for file := range files {
+		if change := fileChange(old[file], new[file]); change != "" {
+			result = append(result, fmt.Sprintf("%s %s", file, change))
+		}
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// poll returns a description of how the files changed, once the change
+// has been stable since the previous poll, otherwise an empty string.
+// Removal of all files is only reported when they re-appear.
+func (w *fileWatcher) poll() string {
+	cur := takeSnapshot(w.path)
+
+	if len(snapshotChanges(w.last, cur)) == 0 {
+		w.waiting = false
+		return ""
+	}
+
+	// wait for the files to settle before reporting the change
+	if !w.waiting || len(snapshotChanges(w.pending, cur)) > 0 {
+		w.pending = cur
+		w.waiting = true
+		return ""
+	}
+
+	changes := snapshotChanges(w.last, cur)
+	w.waiting = false
+	w.last = cur
+	if len(cur) == 0 {
+		logger.Printf("Watched files %s were removed", w.path)
+		return ""
+	}
+
+	return strings.Join(changes, ", ")
+}
+
+// WatchFile polls the metric definition files at path every interval
+// and calls fn with a description of each change to them
+func WatchFile(path string, interval time.Duration, fn func(change string)) {
+	w := newFileWatcher(path)
+	for range time.Tick(interval) {
+		if change := w.poll(); change != "" {
+			fn(change)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileWatcher(t *testing.T) {
+	SetTestLogger()
+
+	dir, err := ioutil.TempDir("", "prom_multi_proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metrics.json")
+	write := func(file, content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(path, "[]")
+	w := newFileWatcher(path)
+
+	for i, tt := range []struct {
+		action func()
+		r      string
+	}{
+		{func() {}, ""},
+		// a change is reported once it has been stable for a poll
+		{func() { write(path, "[ ]") }, ""},
+		{func() {}, path + " modified"},
+		{func() {}, ""},
+		// changes which are still in progress are not reported
+		{func() { write(path, "[  ]") }, ""},
+		{func() { write(path, "[   ]") }, ""},
+		{func() {}, path + " modified"},
+		// atomic rename-based deploys
+		{func() {
+			write(path+".tmp", "[]")
+			os.Rename(path+".tmp", path)
+		}, ""},
+		{func() {}, path + " replaced"},
+		// removal is not reported, re-creation is
+		{func() { os.Remove(path) }, ""},
+		{func() {}, ""},
+		{func() { write(path, "[]") }, ""},
+		{func() {}, path + " created"},
+	} {
+		tt.action()
+		if r := w.poll(); r != tt.r {
+			t.Fatalf("Poll %d => %q, want %q", i, r, tt.r)
+		}
+	}
+}
+
+func TestFileWatcherDir(t *testing.T) {
+	SetTestLogger()
+
+	dir, err := ioutil.TempDir("", "prom_multi_proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a.json")
+	b := filepath.Join(dir, "b.json")
+	write := func(file, content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(a, "[]")
+	w := newFileWatcher(dir)
+
+	for i, tt := range []struct {
+		action func()
+		r      string
+	}{
+		{func() { write(b, "[]") }, ""},
+		{func() {}, b + " created"},
+		{func() { write(a, "[ ]") }, ""},
+		{func() {}, a + " modified"},
+		// files with unknown extensions are ignored
+		{func() { write(filepath.Join(dir, "c.txt"), "[]") }, ""},
+		{func() {}, ""},
+		{func() {
+			os.Remove(a)
+			write(b, "[ ]")
+		}, ""},
+		{func() {}, a + " removed, " + b + " modified"},
+	} {
+		tt.action()
+		if r := w.poll(); r != tt.r {
+			t.Fatalf("Poll %d => %q, want %q", i, r, tt.r)
+		}
+	}
+}